@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"math"
+	"sort"
+
+	"gocv.io/x/gocv"
+)
+
+func init() {
+	RegisterProcessor("align", newAlignStage)
+}
+
+// faceAlignment is where the align stage found a face's eyes, in pixels of
+// the frame. Left and right are as seen in the picture.
+type faceAlignment struct {
+	LeftEye  image.Point `json:"left_eye"`
+	RightEye image.Point `json:"right_eye"`
+	Angle    float64     `json:"angle"`
+	OK       bool        `json:"ok"`
+	Reason   string      `json:"reason,omitempty"`
+}
+
+// alignStage finds the eyes of every face and sets ctx.Alignments, from
+// which recognition and enrollment cut the same level, evenly scaled crop.
+type alignStage struct {
+	cfg  alignConfig
+	eyes *gocv.CascadeClassifier
+}
+
+func newAlignStage(cam *camera, output string, params json.RawMessage) (Processor, error) {
+	var cfg alignConfig
+	if err := json.Unmarshal(params, &cfg); err != nil {
+		return nil, err
+	}
+	eyes, err := loadEyeCascade(cfg.eyeCascade(), "align")
+	if err != nil {
+		return nil, err
+	}
+	return &alignStage{cfg: cfg, eyes: eyes}, nil
+}
+
+func (s *alignStage) Process(ctx *FrameContext) error {
+	ctx.Alignments = make([]*faceAlignment, len(ctx.Faces))
+	for i, r := range ctx.Faces {
+		a := s.align(ctx.Image, r)
+		ctx.Alignments[i] = &a
+	}
+	return nil
+}
+
+// align finds the eyes of the face at r in img.
+func (s *alignStage) align(img gocv.Mat, r image.Rectangle) faceAlignment {
+	// eyes sit in the upper part of the face
+	upper := image.Rect(r.Min.X, r.Min.Y, r.Max.X, r.Min.Y+r.Dy()*6/10).Intersect(image.Rect(0, 0, img.Cols(), img.Rows()))
+	if upper.Empty() {
+		return faceAlignment{Reason: "face outside the frame"}
+	}
+	region := img.Region(upper)
+	gray := toGray(region, 0)
+	region.Close()
+	defer gray.Close()
+
+	eyeMin, eyeMax := r.Dx()/8, r.Dx()/2
+	eyes := s.eyes.DetectMultiScaleWithParams(gray, 1.1, 3, 0, image.Pt(eyeMin, eyeMin), image.Pt(eyeMax, eyeMax))
+	return alignEyes(eyes, upper, s.cfg.maxAngle())
+}
+
+// alignEyes works out the alignment of a face from the eyes found in upper,
+// the upper part of it, in pixels of upper. It takes the biggest eye in each
+// half of the face.
+func alignEyes(eyes []image.Rectangle, upper image.Rectangle, maxAngle float64) faceAlignment {
+	sort.Slice(eyes, func(i, j int) bool { return eyes[i].Dx() > eyes[j].Dx() })
+	var left, right *image.Rectangle
+	for i := range eyes {
+		e := &eyes[i]
+		if c := (e.Min.X + e.Max.X) / 2; c < upper.Dx()/2 && left == nil {
+			left = e
+		} else if c >= upper.Dx()/2 && right == nil {
+			right = e
+		}
+	}
+	if left == nil || right == nil {
+		return faceAlignment{Reason: fmt.Sprintf("found %d eyes", len(eyes))}
+	}
+
+	a := faceAlignment{
+		LeftEye:  left.Min.Add(left.Max).Div(2).Add(upper.Min),
+		RightEye: right.Min.Add(right.Max).Div(2).Add(upper.Min),
+	}
+	d := a.RightEye.Sub(a.LeftEye)
+	a.Angle = math.Atan2(float64(d.Y), float64(d.X)) * 180 / math.Pi
+	if math.Abs(a.Angle) > maxAngle {
+		a.Reason = fmt.Sprintf("head tilted %.0f degrees", a.Angle)
+		return a
+	}
+	a.OK = true
+	return a
+}
+
+func (s *alignStage) Close() error {
+	return s.eyes.Close()
+}
+
+// faceCrop is a face to recognize and its alignment, if any.
+type faceCrop struct {
+	Rect  image.Rectangle
+	Align *faceAlignment
+}
+
+// faceCrops returns the faces at rects with the alignments found for them.
+func (ctx *FrameContext) faceCrops(rects []image.Rectangle) []faceCrop {
+	crops := make([]faceCrop, len(rects))
+	for i, r := range rects {
+		crops[i] = faceCrop{Rect: r}
+		if j := ctx.faceIndex(r); j >= 0 && j < len(ctx.Alignments) {
+			crops[i].Align = ctx.Alignments[j]
+		}
+	}
+	return crops
+}
+
+// normalizedCrop cuts the face out of img for facebox. An aligned face is
+// rotated so its eyes are level and scaled so they sit at the same place in
+// every crop. Otherwise it falls back to the face with a margin around it,
+// and reports why.
+func (fr *faceRecognizer) normalizedCrop(img gocv.Mat, fc faceCrop) (crop gocv.Mat, aligned bool, reason string) {
+	a := fc.Align
+	if a == nil || !a.OK {
+		reason = "not aligned"
+		if a != nil && a.Reason != "" {
+			reason = a.Reason
+		}
+		region := img.Region(withMargin(fc.Rect, fr.cfg.margin()).Intersect(image.Rect(0, 0, img.Cols(), img.Rows())))
+		crop = region.Clone()
+		region.Close()
+		return crop, false, reason
+	}
+
+	size := float64(fr.cfg.size())
+	center := a.LeftEye.Add(a.RightEye).Div(2)
+	dist := math.Hypot(float64(a.RightEye.X-a.LeftEye.X), float64(a.RightEye.Y-a.LeftEye.Y))
+	scale := fr.cfg.eyeDistance() * size / dist
+
+	// rotate and scale about the eyes, then move them to their place
+	m := gocv.GetRotationMatrix2D(center, a.Angle, scale)
+	defer m.Close()
+	m.SetDoubleAt(0, 2, m.GetDoubleAt(0, 2)+size/2-float64(center.X))
+	m.SetDoubleAt(1, 2, m.GetDoubleAt(1, 2)+size*fr.cfg.eyeHeight()-float64(center.Y))
+
+	crop = gocv.NewMat()
+	gocv.WarpAffine(img, &crop, m, image.Pt(int(size), int(size)))
+	return crop, true, ""
+}
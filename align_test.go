@@ -0,0 +1,85 @@
+package main
+
+import (
+	"image"
+	"math"
+	"testing"
+)
+
+func TestAlignEyes(t *testing.T) {
+	// the upper part of a face from x 100 to 200; eyes are found in pixels of
+	// it and reported in pixels of the frame
+	upper := image.Rect(100, 50, 200, 110)
+	eye := func(x, y, size int) image.Rectangle {
+		return image.Rect(x-size/2, y-size/2, x+size/2, y+size/2)
+	}
+	tilt := math.Atan2(10, 40) * 180 / math.Pi
+
+	tests := []struct {
+		name        string
+		eyes        []image.Rectangle
+		left, right image.Point
+		angle       float64
+		ok          bool
+		reason      string
+	}{
+		{
+			name: "level",
+			eyes: []image.Rectangle{eye(70, 30, 20), eye(30, 30, 20)},
+			left: image.Pt(130, 80), right: image.Pt(170, 80),
+			ok: true,
+		},
+		{
+			name: "right eye lower",
+			eyes: []image.Rectangle{eye(30, 30, 20), eye(70, 40, 20)},
+			left: image.Pt(130, 80), right: image.Pt(170, 90),
+			angle: tilt, ok: true,
+		},
+		{
+			name: "right eye higher",
+			eyes: []image.Rectangle{eye(30, 40, 20), eye(70, 30, 20)},
+			left: image.Pt(130, 90), right: image.Pt(170, 80),
+			angle: -tilt, ok: true,
+		},
+		{
+			name: "tilted too far",
+			eyes: []image.Rectangle{eye(30, 10, 16), eye(70, 50, 16)},
+			left: image.Pt(130, 60), right: image.Pt(170, 100),
+			angle: 45, reason: "head tilted 45 degrees",
+		},
+		{
+			name: "biggest eye in each half",
+			eyes: []image.Rectangle{eye(35, 30, 10), eye(25, 30, 30), eye(70, 30, 20), eye(90, 10, 10)},
+			left: image.Pt(125, 80), right: image.Pt(170, 80),
+			ok: true,
+		},
+		{
+			name:   "one eye",
+			eyes:   []image.Rectangle{eye(30, 30, 20)},
+			reason: "found 1 eyes",
+		},
+		{
+			name:   "both in one half",
+			eyes:   []image.Rectangle{eye(20, 30, 20), eye(40, 30, 16)},
+			reason: "found 2 eyes",
+		},
+		{
+			name:   "no eyes",
+			reason: "found 0 eyes",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := alignEyes(tt.eyes, upper, 30)
+			if a.LeftEye != tt.left || a.RightEye != tt.right {
+				t.Errorf("eyes = %v, %v, want %v, %v", a.LeftEye, a.RightEye, tt.left, tt.right)
+			}
+			if math.Abs(a.Angle-tt.angle) > 1e-9 {
+				t.Errorf("angle = %v, want %v", a.Angle, tt.angle)
+			}
+			if a.OK != tt.ok || a.Reason != tt.reason {
+				t.Errorf("ok, reason = %t, %q, want %t, %q", a.OK, a.Reason, tt.ok, tt.reason)
+			}
+		})
+	}
+}
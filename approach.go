@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"image"
+	"math"
+	"sort"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+func init() {
+	RegisterProcessor("approach", newApproachStage)
+}
+
+// approachState is what a face is doing in front of the kiosk.
+type approachState string
+
+const (
+	approachPassing     approachState = "passing"
+	approachApproaching approachState = "approaching"
+	approachEngaged     approachState = "engaged"
+)
+
+// approachEvent is the data of an "approach" event, raised whenever a
+// face's state changes, so the UI can greet a student before they are
+// recognized. Track is the face's track, or an ID the approach stage gave it
+// if the pipeline doesn't track.
+type approachEvent struct {
+	Track string        `json:"track"`
+	State approachState `json:"state"`
+}
+
+// approachWidth is the width frames are scaled to for optical flow.
+const approachWidth = 320
+
+// approachMatchIoU is how much a face has to overlap where a face was last
+// frame to be taken for the same one when the pipeline doesn't track.
+const approachMatchIoU = 0.3
+
+// approachSample is a face's size at one frame.
+type approachSample struct {
+	at   time.Time
+	size int
+}
+
+// approachTrack is what the classifier knows of one track, or of one face
+// followed from frame to frame when the pipeline doesn't track.
+type approachTrack struct {
+	id       string
+	rect     image.Rectangle
+	state    approachState
+	samples  []approachSample
+	lateral  float64 // smoothed sideways flow, in face widths per frame
+	expand   float64 // smoothed outward flow, in face widths per frame
+	stillAt  time.Time
+	lastSeen time.Time
+}
+
+// approachStage classifies every face as passing, approaching or engaged,
+// and stores the state in ctx.Approach and, if the pipeline tracks, in
+// ctx.Tracks. A student walking up to the kiosk grows in the frame and the
+// flow around their face points outwards; someone walking past moves
+// sideways. Engaged students are the ones who have stopped in front of the
+// kiosk, and only they are checked in automatically. Without a track stage
+// before it, it follows faces itself by how much they overlap from one frame
+// to the next.
+type approachStage struct {
+	cfg      approachConfig
+	prevGray gocv.Mat
+	tracks   map[string]*approachTrack
+	next     int
+}
+
+func newApproachStage(cam *camera, output string, params json.RawMessage) (Processor, error) {
+	var cfg approachConfig
+	if err := json.Unmarshal(params, &cfg); err != nil {
+		return nil, err
+	}
+	return &approachStage{cfg: cfg, prevGray: gocv.NewMat(), tracks: make(map[string]*approachTrack)}, nil
+}
+
+func (s *approachStage) Process(ctx *FrameContext) error {
+	gray := toGray(ctx.Image, approachWidth)
+	scale := float64(gray.Cols()) / float64(ctx.Image.Cols())
+
+	ctx.Approach = make([]approachState, len(ctx.Faces))
+	for i, t := range s.match(ctx) {
+		r := ctx.Faces[i]
+		if !s.prevGray.Empty() {
+			lateral, expand := faceFlow(s.prevGray, gray, scaleRect(r, scale))
+			t.lateral = 0.7*t.lateral + 0.3*lateral
+			t.expand = 0.7*t.expand + 0.3*expand
+		}
+		if state := s.classify(t, r, ctx.Time); state != t.state {
+			t.state = state
+			ctx.Emit(event{Type: "approach", Data: approachEvent{Track: t.id, State: state}})
+		}
+		ctx.Approach[i] = t.state
+		if i < len(ctx.Tracks) {
+			ctx.Tracks[i].Approach = t.state
+		}
+	}
+
+	for id, t := range s.tracks {
+		if ctx.Time.Sub(t.lastSeen) > s.cfg.window() {
+			delete(s.tracks, id)
+		}
+	}
+	s.prevGray.Close()
+	s.prevGray = gray
+	return nil
+}
+
+// match returns what the classifier knows of each of ctx.Faces, starting
+// afresh for faces it hasn't seen. Tracked faces are known by their track.
+// Otherwise each face is taken for the face of last frame it overlaps most,
+// as the track stage matches detections to tracks.
+func (s *approachStage) match(ctx *FrameContext) []*approachTrack {
+	seen := make([]*approachTrack, len(ctx.Faces))
+	if len(ctx.Tracks) == len(ctx.Faces) {
+		for i, ft := range ctx.Tracks {
+			seen[i] = s.tracks[ft.ID]
+			if seen[i] == nil {
+				seen[i] = &approachTrack{id: ft.ID, state: approachPassing}
+				s.tracks[ft.ID] = seen[i]
+			}
+		}
+	} else {
+		type pair struct {
+			face int
+			t    *approachTrack
+			iou  float64
+		}
+		var pairs []pair
+		for i, r := range ctx.Faces {
+			for _, t := range s.tracks {
+				if v := iou(r, t.rect); v >= approachMatchIoU {
+					pairs = append(pairs, pair{i, t, v})
+				}
+			}
+		}
+		sort.Slice(pairs, func(i, j int) bool { return pairs[i].iou > pairs[j].iou })
+
+		used := make(map[*approachTrack]bool)
+		for _, p := range pairs {
+			if seen[p.face] != nil || used[p.t] {
+				continue
+			}
+			used[p.t] = true
+			seen[p.face] = p.t
+		}
+		for i := range ctx.Faces {
+			if seen[i] == nil {
+				s.next++
+				seen[i] = &approachTrack{id: fmt.Sprintf("%s-face-%d", ctx.Camera, s.next), state: approachPassing}
+				s.tracks[seen[i].id] = seen[i]
+			}
+		}
+	}
+
+	for i, t := range seen {
+		t.rect, t.lastSeen = ctx.Faces[i], ctx.Time
+	}
+	return seen
+}
+
+// classify decides what the face of t, now at r, is doing.
+func (s *approachStage) classify(t *approachTrack, r image.Rectangle, now time.Time) approachState {
+	t.samples = append(t.samples, approachSample{at: now, size: r.Dx()})
+	for len(t.samples) > 1 && now.Sub(t.samples[0].at) > s.cfg.window() {
+		t.samples = t.samples[1:]
+	}
+
+	still := t.lateral < s.cfg.maxLateral() && r.Dx() >= s.cfg.minSize()
+	if !still {
+		t.stillAt = time.Time{}
+	} else if t.stillAt.IsZero() {
+		t.stillAt = now
+	}
+
+	growth := float64(r.Dx()) / float64(t.samples[0].size)
+	switch {
+	case still && now.Sub(t.stillAt) >= s.cfg.dwell():
+		return approachEngaged
+	case t.lateral >= s.cfg.maxLateral():
+		return approachPassing
+	case growth >= s.cfg.minGrowth() || t.expand >= s.cfg.minExpansion() || still:
+		return approachApproaching
+	}
+	return approachPassing
+}
+
+// faceFlow runs dense optical flow over the face at r and the area around
+// it, returning how far it moved sideways and how much it spread outwards,
+// both in face widths per frame.
+func faceFlow(prev, next gocv.Mat, r image.Rectangle) (lateral, expand float64) {
+	bounds := image.Rect(0, 0, next.Cols(), next.Rows())
+	area := withMargin(r, 0.5).Intersect(bounds)
+	if area.Dx() < 8 || area.Dy() < 8 || r.Dx() == 0 {
+		return 0, 0
+	}
+
+	a, b := prev.Region(area), next.Region(area)
+	defer a.Close()
+	defer b.Close()
+	flow := gocv.NewMat()
+	defer flow.Close()
+	gocv.CalcOpticalFlowFarneback(a, b, &flow, 0.5, 3, 15, 3, 5, 1.2, 0)
+
+	v := float32s(flow)
+	w, h := area.Dx(), area.Dy()
+	cx, cy := float64(w)/2, float64(h)/2
+	var sumX, sumRadial float64
+	n := 0
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			i := 2 * (y*w + x)
+			if i+1 >= len(v) {
+				break
+			}
+			fx, fy := float64(v[i]), float64(v[i+1])
+			sumX += fx
+			dx, dy := float64(x)-cx, float64(y)-cy
+			if d := math.Hypot(dx, dy); d > 0 {
+				sumRadial += (fx*dx + fy*dy) / d
+			}
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, 0
+	}
+	size := float64(r.Dx())
+	return math.Abs(sumX/float64(n)) / size, sumRadial / float64(n) / size
+}
+
+// scaleRect scales r by scale.
+func scaleRect(r image.Rectangle, scale float64) image.Rectangle {
+	return image.Rect(
+		int(float64(r.Min.X)*scale), int(float64(r.Min.Y)*scale),
+		int(float64(r.Max.X)*scale), int(float64(r.Max.Y)*scale),
+	)
+}
+
+// float32s returns the elements of a continuous CV_32F Mat, whatever its
+// shape or number of channels.
+func float32s(m gocv.Mat) []float32 {
+	data := m.ToBytes()
+	v := make([]float32, len(data)/4)
+	for i := range v {
+		v[i] = math.Float32frombits(binary.LittleEndian.Uint32(data[4*i:]))
+	}
+	return v
+}
+
+func (s *approachStage) Close() error {
+	return s.prevGray.Close()
+}
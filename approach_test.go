@@ -0,0 +1,120 @@
+package main
+
+import (
+	"image"
+	"testing"
+	"time"
+)
+
+// approachStep holds a face's width and smoothed flow for a number of
+// frames, ten a second.
+type approachStep struct {
+	frames  int
+	size    int
+	lateral float64
+	expand  float64
+}
+
+func TestApproachClassify(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []approachStep
+		want  approachState
+	}{
+		{"walks past", []approachStep{{10, 100, 0.05, 0}}, approachPassing},
+		{"walks up", []approachStep{{1, 60, 0.01, 0}, {5, 70, 0.01, 0}, {5, 80, 0.01, 0}}, approachApproaching},
+		{"walks up slowly", []approachStep{{1, 70, 0.01, 0}, {10, 72, 0.01, 0}}, approachPassing},
+		{"face spreads outwards", []approachStep{{10, 70, 0.01, 0.01}}, approachApproaching},
+		{"walks up and past", []approachStep{{1, 60, 0.01, 0}, {5, 80, 0.05, 0}}, approachPassing},
+		{"stops in front", []approachStep{{11, 120, 0.01, 0}}, approachEngaged},
+		{"has just stopped", []approachStep{{5, 120, 0.01, 0}}, approachApproaching},
+		{"stops too far away", []approachStep{{11, 60, 0, 0}}, approachPassing},
+		{"stops and walks off", []approachStep{{11, 120, 0.01, 0}, {1, 120, 0.05, 0}}, approachPassing},
+		{"grew longer ago than the window", []approachStep{{1, 60, 0.01, 0}, {30, 80, 0.01, 0}}, approachPassing},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &approachStage{}
+			track := &approachTrack{state: approachPassing}
+			now := time.Now()
+			var got approachState
+			for _, step := range tt.steps {
+				for i := 0; i < step.frames; i++ {
+					track.lateral, track.expand = step.lateral, step.expand
+					got = s.classify(track, image.Rect(0, 0, step.size, step.size), now)
+					now = now.Add(100 * time.Millisecond)
+				}
+			}
+			if got != tt.want {
+				t.Errorf("classify = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestApproachMatch follows faces without a track stage: one walking past,
+// one standing still, and a third that turns up later somewhere else.
+func TestApproachMatch(t *testing.T) {
+	s := &approachStage{tracks: make(map[string]*approachTrack)}
+	now := time.Now()
+	var walker, stander string
+	for i := 0; i < 10; i++ {
+		ctx := &FrameContext{Camera: "lobby", Time: now, Faces: []image.Rectangle{
+			image.Rect(400, 100, 500, 200),
+			image.Rect(i*15, 120, i*15+100, 220),
+		}}
+		seen := s.match(ctx)
+		if i == 0 {
+			stander, walker = seen[0].id, seen[1].id
+		}
+		if seen[0].id != stander || seen[1].id != walker {
+			t.Fatalf("frame %d: faces are %s and %s, want %s and %s", i, seen[0].id, seen[1].id, stander, walker)
+		}
+		now = now.Add(100 * time.Millisecond)
+	}
+	if stander == walker {
+		t.Fatalf("both faces are %s", stander)
+	}
+
+	ctx := &FrameContext{Camera: "lobby", Time: now, Faces: []image.Rectangle{
+		image.Rect(400, 100, 500, 200),
+		image.Rect(150, 400, 250, 500),
+	}}
+	seen := s.match(ctx)
+	if seen[0].id != stander {
+		t.Errorf("the standing face became %s, want %s", seen[0].id, stander)
+	}
+	if seen[1].id == stander || seen[1].id == walker {
+		t.Errorf("a new face was taken for %s", seen[1].id)
+	}
+
+	// with a track stage the tracks say who is who
+	ctx = &FrameContext{Camera: "lobby", Time: now, Faces: ctx.Faces, Tracks: []faceTrack{{ID: "lobby-7"}, {ID: "lobby-8"}}}
+	seen = s.match(ctx)
+	if seen[0].id != "lobby-7" || seen[1].id != "lobby-8" {
+		t.Errorf("tracked faces are %s and %s, want lobby-7 and lobby-8", seen[0].id, seen[1].id)
+	}
+}
+
+func TestApproachCandidate(t *testing.T) {
+	passer, student := image.Rect(0, 0, 150, 150), image.Rect(300, 0, 420, 120)
+	s := &autoCheckinStage{}
+	ctx := &FrameContext{
+		Faces:    []image.Rectangle{passer, student},
+		Approach: []approachState{approachPassing, approachEngaged},
+	}
+	if got, ok := s.candidate(ctx); !ok || got != student {
+		t.Errorf("candidate = %v, %t; want the engaged student %v", got, ok, student)
+	}
+
+	ctx.Approach = []approachState{approachPassing, approachApproaching}
+	if got, ok := s.candidate(ctx); ok {
+		t.Errorf("candidate = %v with nobody engaged", got)
+	}
+
+	// without an approach stage the largest face will do
+	ctx.Approach = nil
+	if got, ok := s.candidate(ctx); !ok || got != passer {
+		t.Errorf("candidate = %v, %t; want the largest face %v", got, ok, passer)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"image"
+	"log"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+func init() {
+	RegisterProcessor("autocheckin", newAutoCheckinStage)
+}
+
+// autoCheckinStage checks students in hands-free. It follows the largest
+// face good enough for recognition, and once that face has held still for
+// enough frames it recognizes it in the background and publishes a check-in.
+// It has to run after the detect stage, and after quality if there is one.
+type autoCheckinStage struct {
+	cam *camera
+	cfg checkinConfig
+
+	last   image.Rectangle // the face being followed
+	steady int             // frames it has held still for
+
+	// busy is set while a recognition is in flight.
+	busy chan struct{}
+	// triggered has where and when recognition last ran, to ignore a
+	// student who is still standing in the same place.
+	triggered []trigger
+	// seen has when each student was last checked in or asked to confirm a
+	// check-in, read and written by the recognition goroutine only.
+	seen map[string]time.Time
+}
+
+type trigger struct {
+	rect image.Rectangle
+	at   time.Time
+}
+
+func newAutoCheckinStage(cam *camera, output string, params json.RawMessage) (Processor, error) {
+	var cfg checkinConfig
+	if err := json.Unmarshal(params, &cfg); err != nil {
+		return nil, err
+	}
+	return &autoCheckinStage{
+		cam:  cam,
+		cfg:  cfg,
+		busy: make(chan struct{}, 1),
+		seen: make(map[string]time.Time),
+	}, nil
+}
+
+func (s *autoCheckinStage) Process(ctx *FrameContext) error {
+	face, ok := s.candidate(ctx)
+	if !ok {
+		s.last, s.steady = image.Rectangle{}, 0
+		return nil
+	}
+
+	if s.steady > 0 && s.heldStill(face) {
+		s.steady++
+	} else {
+		s.steady = 1
+	}
+	s.last = face
+	if s.steady < s.cfg.frames() || s.recentlyTriggered(face, ctx.Time) {
+		return nil
+	}
+	liveness := ctx.livenessOf(face)
+	if liveness != nil && liveness.Blocked {
+		// wait for the face to prove it is live, or for the student to go
+		return nil
+	}
+
+	select {
+	case s.busy <- struct{}{}:
+	default:
+		// still recognizing the last one
+		return nil
+	}
+	s.steady = 0
+	s.triggered = append(s.triggered, trigger{rect: face, at: ctx.Time})
+
+	// facebox is far too slow to wait for on the pipeline goroutine
+	img := ctx.Image.Clone()
+	crop := ctx.faceCrops([]image.Rectangle{face})[0]
+	go func() {
+		defer func() { <-s.busy }()
+		defer img.Close()
+		s.recognize(img, crop, liveness)
+	}()
+	return nil
+}
+
+// candidate returns the largest face fit for recognition. When an approach
+// stage classifies the faces, only engaged students are candidates.
+func (s *autoCheckinStage) candidate(ctx *FrameContext) (image.Rectangle, bool) {
+	var best image.Rectangle
+	for i, r := range ctx.Faces {
+		if q := ctx.Quality; q != nil && (i >= len(q.Faces) || !q.Faces[i].OK) {
+			continue
+		}
+		if ctx.Approach != nil && (i >= len(ctx.Approach) || ctx.Approach[i] != approachEngaged) {
+			continue
+		}
+		if r.Dx() >= s.cfg.minSize() && r.Dx() > best.Dx() {
+			best = r
+		}
+	}
+	return best, !best.Empty()
+}
+
+// heldStill reports whether face is where the followed face was last frame.
+func (s *autoCheckinStage) heldStill(face image.Rectangle) bool {
+	limit := s.cfg.maxMove() * float64(s.last.Dx())
+	moved := distance(face, s.last.Min.Add(s.last.Max).Div(2))
+	resized := float64(face.Dx() - s.last.Dx())
+	return moved <= limit && resized <= limit && -resized <= limit
+}
+
+// recentlyTriggered reports whether recognition already ran for a face at
+// the same place within the position cooldown.
+func (s *autoCheckinStage) recentlyTriggered(face image.Rectangle, now time.Time) bool {
+	var recent []trigger
+	hit := false
+	for _, t := range s.triggered {
+		if now.Sub(t.at) >= s.cfg.positionCooldown() {
+			continue
+		}
+		recent = append(recent, t)
+		if iou(face, t.rect) >= 0.5 {
+			hit = true
+		}
+	}
+	s.triggered = recent
+	return hit
+}
+
+// recognize runs recognition on the face and checks the student in unless
+// they were checked in or asked to confirm within the identity cooldown,
+// failed the liveness check or were recognized too unsurely to ask.
+func (s *autoCheckinStage) recognize(img gocv.Mat, face faceCrop, liveness *livenessResult) {
+	res := recognizer.recognize(img, []faceCrop{face}, s.cam.identities())[0]
+	res.Liveness = liveness
+	s.cam.dropUnsure(&res)
+	if !res.checkable() {
+		return
+	}
+
+	now := time.Now()
+	if at, ok := s.seen[res.StudentName]; ok && now.Sub(at) < s.cfg.identityCooldown() {
+		return
+	}
+
+	// a student asked to confirm counts as seen too, or they would be asked
+	// again on every frame until they answered; once they confirm, the
+	// confirmation checks them in
+	if s.cam.checkIn(res, true) {
+		log.Printf("camera %s: checked in %s automatically", s.cam.id, res.StudentName)
+	} else {
+		log.Printf("camera %s: asked %s to confirm their check-in", s.cam.id, res.StudentName)
+	}
+	s.seen[res.StudentName] = now
+}
+
+func (s *autoCheckinStage) Close() error {
+	return nil
+}
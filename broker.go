@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+// errFrameTimeout is returned when the broker has no suitable frame in time.
+var errFrameTimeout = errors.New("timed out waiting for a camera frame")
+
+// Frame is one captured image stamped with its sequence number and capture
+// time. The Mat belongs to whoever received the frame and must be closed.
+type Frame struct {
+	Seq  uint64
+	Time time.Time
+	Mat  gocv.Mat
+	// Context is what the pipeline found in the frame. It is nil for frames
+	// straight from the camera and must be treated as read-only.
+	Context *FrameContext
+}
+
+// Close releases the frame's image.
+func (f *Frame) Close() error {
+	return f.Mat.Close()
+}
+
+// frameBroker keeps the latest frame published by the capture goroutine and
+// hands out copies to any number of consumers, so nothing but the capture
+// goroutine ever touches the device.
+type frameBroker struct {
+	lock   sync.Mutex
+	latest gocv.Mat
+	seq    uint64
+	at     time.Time
+	ctx    *FrameContext
+	// ready is closed and replaced on every publish to wake waiting consumers.
+	ready chan struct{}
+}
+
+func newFrameBroker() *frameBroker {
+	return &frameBroker{
+		latest: gocv.NewMat(),
+		ready:  make(chan struct{}),
+	}
+}
+
+// publish stores a copy of img as the latest frame and returns its sequence number.
+func (b *frameBroker) publish(img gocv.Mat) uint64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.store(img, b.seq+1, time.Now(), nil)
+	return b.seq
+}
+
+// publishFrame stores a copy of a frame that already has a sequence number
+// and capture time, such as a pipeline output, along with its context.
+func (b *frameBroker) publishFrame(img gocv.Mat, seq uint64, at time.Time, ctx *FrameContext) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.store(img, seq, at, ctx)
+}
+
+func (b *frameBroker) store(img gocv.Mat, seq uint64, at time.Time, ctx *FrameContext) {
+	img.CopyTo(b.latest)
+	b.seq = seq
+	b.at = at
+	b.ctx = ctx
+
+	close(b.ready)
+	b.ready = make(chan struct{})
+}
+
+// Latest returns the most recent frame, waiting up to timeout if nothing has
+// been captured yet.
+func (b *frameBroker) Latest(timeout time.Duration) (Frame, error) {
+	return b.Next(0, timeout)
+}
+
+// Fresh returns the first frame captured after the call.
+func (b *frameBroker) Fresh(timeout time.Duration) (Frame, error) {
+	b.lock.Lock()
+	seq := b.seq
+	b.lock.Unlock()
+	return b.Next(seq, timeout)
+}
+
+// Next returns the latest frame once its sequence number is greater than after.
+func (b *frameBroker) Next(after uint64, timeout time.Duration) (Frame, error) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for {
+		b.lock.Lock()
+		if b.seq > after {
+			f := Frame{Seq: b.seq, Time: b.at, Mat: b.latest.Clone(), Context: b.ctx}
+			b.lock.Unlock()
+			return f, nil
+		}
+		ready := b.ready
+		b.lock.Unlock()
+
+		select {
+		case <-ready:
+		case <-deadline.C:
+			return Frame{}, errFrameTimeout
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// camera is one named camera: its supervisor and capture goroutine, the
+// broker its consumers read from, its pipeline and outputs and, when
+// enabled, the clip recorder and tamper detector.
+type camera struct {
+	id     string
+	cfg    cameraConfig
+	frames *frameBroker
+	super  *supervisor
+	clips  *clipRecorder
+	tamper *tamperDetector
+
+	pipeline *pipeline
+	// analyzed holds frames after the pipeline's shared stages, which is
+	// what recognition works on.
+	analyzed *frameBroker
+	outputs  map[string]*pipelineOutput
+	// tracker is the pipeline's track stage, if it has one.
+	tracker  *trackStage
+	checkins checkinLog
+	// confirmations holds a check-in waiting for a gesture.
+	confirmations confirmations
+}
+
+func newCamera(cfg cameraConfig, all *config) (*camera, error) {
+	frames := newFrameBroker()
+	cam := &camera{
+		id:       cfg.ID,
+		cfg:      cfg,
+		frames:   frames,
+		super:    newSupervisor(cfg, all.Supervisor, frames),
+		analyzed: newFrameBroker(),
+		outputs:  make(map[string]*pipelineOutput),
+	}
+	if cfg.Tamper.Enabled {
+		cam.tamper = newTamperDetector(cfg.ID, cfg.Tamper, frames)
+	}
+
+	pc := cfg.pipeline()
+	for name := range pc.Outputs {
+		cam.outputs[name] = &pipelineOutput{
+			name:    name,
+			stream:  newMJPEGStream(cfg.ID),
+			frames:  newFrameBroker(),
+			privacy: "off",
+		}
+	}
+	var err error
+	if cam.pipeline, err = newPipeline(cam, pc); err != nil {
+		return nil, err
+	}
+
+	if all.Clips.Dir != "" {
+		recorded := frames
+		if all.Clips.Output != "" {
+			out, ok := cam.outputs[all.Clips.Output]
+			if !ok {
+				return nil, fmt.Errorf("camera %s: no output %q to record clips from", cfg.ID, all.Clips.Output)
+			}
+			recorded = out.frames
+		}
+		cam.clips = newClipRecorder(cfg.ID, all.Clips, recorded)
+	}
+	return cam, nil
+}
+
+// start runs the camera's capture, pipeline, clip and tamper goroutines.
+func (c *camera) start() {
+	go c.super.run()
+	go c.pipeline.run()
+	if c.clips != nil {
+		go c.clips.run()
+	}
+	if c.tamper != nil {
+		go c.tamper.run()
+	}
+}
+
+// health reports the camera's supervisor and tamper state, and which
+// outputs hide faces.
+func (c *camera) health() cameraHealth {
+	h := c.super.Health()
+	if c.tamper != nil {
+		status := c.tamper.Status()
+		h.Tamper = &status
+	}
+	h.Privacy = make(map[string]string)
+	for name, out := range c.outputs {
+		h.Privacy[name] = out.privacy
+	}
+	return h
+}
+
+// cameraSet holds the configured cameras in config order. The first one is
+// the default for routes that don't name a camera.
+type cameraSet struct {
+	byID  map[string]*camera
+	order []*camera
+}
+
+func newCameraSet(cfg *config) (*cameraSet, error) {
+	set := &cameraSet{byID: make(map[string]*camera)}
+	for _, cc := range cfg.cameras() {
+		if _, dup := set.byID[cc.ID]; dup {
+			return nil, fmt.Errorf("camera %q is configured twice", cc.ID)
+		}
+		cam, err := newCamera(cc, cfg)
+		if err != nil {
+			return nil, err
+		}
+		set.byID[cc.ID] = cam
+		set.order = append(set.order, cam)
+	}
+	return set, nil
+}
+
+// start starts every camera.
+func (s *cameraSet) start() {
+	for _, cam := range s.order {
+		cam.start()
+	}
+}
+
+// lookup finds the camera named by the {id} route variable or the camera
+// query parameter, falling back to the default camera when neither is given.
+func (s *cameraSet) lookup(r *http.Request) (*camera, bool) {
+	id := mux.Vars(r)["id"]
+	if id == "" {
+		id = r.URL.Query().Get("camera")
+	}
+	if id == "" {
+		return s.order[0], true
+	}
+	cam, ok := s.byID[id]
+	return cam, ok
+}
+
+// serveStream serves the mjpeg stream of the requested camera output, by
+// default the raw one.
+func (s *cameraSet) serveStream(w http.ResponseWriter, r *http.Request) {
+	cam, ok := s.lookup(r)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	name := mux.Vars(r)["output"]
+	if name == "" {
+		name = "raw"
+	}
+	out, ok := cam.outputs[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	out.stream.ServeHTTP(w, r)
+}
+
+// serveHealth serves the health of the requested camera.
+func (s *cameraSet) serveHealth(w http.ResponseWriter, r *http.Request) {
+	cam, ok := s.lookup(r)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cam.health())
+}
+
+// rebaseline makes the requested camera's tamper detector learn a new
+// baseline, after the camera was moved or refocused on purpose.
+func (s *cameraSet) rebaseline(w http.ResponseWriter, r *http.Request) {
+	cam, ok := s.lookup(r)
+	if !ok || cam.tamper == nil {
+		http.NotFound(w, r)
+		return
+	}
+	cam.tamper.rebaseline()
+	w.WriteHeader(http.StatusAccepted)
+}
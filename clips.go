@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+// clipFrame is a JPEG-encoded frame kept in the pre-event ring buffer.
+type clipFrame struct {
+	at   time.Time
+	jpeg []byte
+}
+
+// pendingClip is a clip that is still collecting frames after its event.
+type pendingClip struct {
+	id     string
+	until  time.Time
+	frames []clipFrame
+}
+
+// clipRecorder keeps the last few seconds of a camera's frames in memory and,
+// when asked, writes a clip covering the time around an event to disk. Frames
+// are kept as JPEGs so a few seconds of video costs a few megabytes.
+type clipRecorder struct {
+	camera string
+	cfg    clipConfig
+	frames *frameBroker
+
+	lock    sync.Mutex
+	ring    []clipFrame
+	pending []*pendingClip
+}
+
+func newClipRecorder(camera string, cfg clipConfig, frames *frameBroker) *clipRecorder {
+	return &clipRecorder{camera: camera, cfg: cfg, frames: frames}
+}
+
+// run feeds the ring buffer from the broker.
+func (c *clipRecorder) run() {
+
+	var seq uint64
+	for {
+		frame, err := c.frames.Next(seq, time.Second)
+		if err != nil {
+			// finish clips even when the camera has stopped sending frames
+			c.flush(time.Now())
+			continue
+		}
+		seq = frame.Seq
+
+		buf, err := gocv.IMEncode(".jpg", frame.Mat)
+		frame.Close()
+		if err != nil {
+			log.Printf("clips %s: unable to encode matrix: %v", c.camera, err)
+			continue
+		}
+
+		c.add(clipFrame{at: frame.Time, jpeg: buf})
+	}
+}
+
+// add appends f to the ring buffer and to every clip still recording.
+func (c *clipRecorder) add(f clipFrame) {
+	c.lock.Lock()
+	c.ring = append(c.ring, f)
+	cutoff := f.at.Add(-c.cfg.before())
+	drop := 0
+	for drop < len(c.ring) && c.ring[drop].at.Before(cutoff) {
+		drop++
+	}
+	c.ring = append(c.ring[:0], c.ring[drop:]...)
+
+	for _, p := range c.pending {
+		if !f.at.After(p.until) {
+			p.frames = append(p.frames, f)
+		}
+	}
+	c.lock.Unlock()
+
+	c.flush(f.at)
+}
+
+// flush writes every pending clip whose recording window ended before now.
+func (c *clipRecorder) flush(now time.Time) {
+	c.lock.Lock()
+	var done []*pendingClip
+	pending := c.pending[:0]
+	for _, p := range c.pending {
+		if now.After(p.until) {
+			done = append(done, p)
+		} else {
+			pending = append(pending, p)
+		}
+	}
+	c.pending = pending
+	c.lock.Unlock()
+
+	for _, p := range done {
+		go c.write(p)
+	}
+}
+
+// record starts a clip for the event with the given ID, covering the
+// configured time before and after now. Once the clip is written a "clip"
+// event gives its path under /clips/.
+func (c *clipRecorder) record(id string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	p := &pendingClip{id: id, until: time.Now().Add(c.cfg.after())}
+	p.frames = append(p.frames, c.ring...)
+	c.pending = append(c.pending, p)
+}
+
+// write encodes the clip's frames to a video file, resampled to the clip
+// frame rate, announces it and prunes old clips.
+func (c *clipRecorder) write(p *pendingClip) {
+	if len(p.frames) == 0 {
+		log.Printf("clips %s: no frames for clip %s", c.camera, p.id)
+		return
+	}
+
+	first, err := gocv.IMDecode(p.frames[0].jpeg, gocv.IMReadColor)
+	if err != nil || first.Empty() {
+		log.Printf("clips %s: can't decode frames for clip %s", c.camera, p.id)
+		return
+	}
+	width, height := first.Cols(), first.Rows()
+	first.Close()
+
+	name := filepath.Join(c.cfg.Dir, p.id+".avi")
+	vw, err := gocv.VideoWriterFile(name, c.cfg.codec(), c.cfg.fps(), width, height, true)
+	if err != nil {
+		log.Printf("clips %s: can't create %s: %v", c.camera, name, err)
+		return
+	}
+	if !vw.IsOpened() {
+		vw.Close()
+		log.Printf("clips %s: can't open %s with codec %s", c.camera, name, c.cfg.codec())
+		return
+	}
+
+	// pick the newest frame at each tick so the clip plays in real time
+	// whatever rate the camera delivered
+	step := frameInterval(c.cfg.fps())
+	start, end := p.frames[0].at, p.frames[len(p.frames)-1].at
+	next, written := 0, 0
+	for t := start; !t.After(end); t = t.Add(step) {
+		for next+1 < len(p.frames) && !p.frames[next+1].at.After(t) {
+			next++
+		}
+		img, err := gocv.IMDecode(p.frames[next].jpeg, gocv.IMReadColor)
+		if err != nil {
+			continue
+		}
+		if img.Cols() == width && img.Rows() == height {
+			if err := vw.Write(img); err == nil {
+				written++
+			}
+		}
+		img.Close()
+	}
+	vw.Close()
+
+	if written == 0 {
+		os.Remove(name)
+		log.Printf("clips %s: no frames written to %s", c.camera, name)
+		return
+	}
+	log.Printf("clips %s: wrote %s", c.camera, name)
+	events.publish(event{Type: "clip", Camera: c.camera, Data: clipEvent{Event: p.id, Clip: "/clips/" + p.id + ".avi"}})
+	if err := pruneClips(c.cfg.Dir, c.cfg.quota()); err != nil {
+		log.Printf("clips: can't prune %s: %v", c.cfg.Dir, err)
+	}
+}
+
+// clipPruneLock stops cameras pruning the shared clip directory at the same time.
+var clipPruneLock sync.Mutex
+
+// pruneClips deletes the oldest clips in dir until they fit in quota bytes.
+func pruneClips(dir string, quota int64) error {
+	if quota <= 0 {
+		return nil
+	}
+
+	clipPruneLock.Lock()
+	defer clipPruneLock.Unlock()
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	var clips []os.FileInfo
+	var total int64
+	for _, fi := range infos {
+		if fi.Mode().IsRegular() && filepath.Ext(fi.Name()) == ".avi" {
+			clips = append(clips, fi)
+			total += fi.Size()
+		}
+	}
+	sort.Slice(clips, func(i, j int) bool { return clips[i].ModTime().Before(clips[j].ModTime()) })
+
+	for _, fi := range clips {
+		if total <= quota {
+			break
+		}
+		if err := os.Remove(filepath.Join(dir, fi.Name())); err != nil {
+			return fmt.Errorf("removing %s: %v", fi.Name(), err)
+		}
+		total -= fi.Size()
+		log.Printf("clips: pruned %s", fi.Name())
+	}
+	return nil
+}
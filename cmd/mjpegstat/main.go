@@ -0,0 +1,42 @@
+// Command mjpegstat connects to a kiosk camera stream and prints the latency
+// and drop rate it sees, to help diagnose laggy kiosk displays.
+//
+//	go run ./cmd/mjpegstat -url http://localhost:8090/camera/north -every 5s
+package main
+
+import (
+	"flag"
+	"log"
+	"time"
+
+	"github.com/alejandroq/kiosk_gocv/mjpegclient"
+)
+
+func main() {
+	url := flag.String("url", "http://localhost:8090/camera", "camera stream URL")
+	every := flag.Duration("every", 5*time.Second, "how often to print stats")
+	flag.Parse()
+
+	c, err := mjpegclient.Dial(*url)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer c.Close()
+
+	next := time.Now().Add(*every)
+	for {
+		part, err := c.Next()
+		if err != nil {
+			log.Fatalln("stream ended:", err)
+		}
+		if time.Now().Before(next) {
+			continue
+		}
+		next = time.Now().Add(*every)
+
+		s := c.Stats()
+		log.Printf("camera=%s seq=%d frames=%d dropped=%d (%.1f%%) latency last=%v avg=%v min=%v max=%v",
+			part.Camera, s.LastSeq, s.Frames, s.Dropped, s.DropRate*100,
+			s.LatencyLast, s.LatencyAvg, s.LatencyMin, s.LatencyMax)
+	}
+}
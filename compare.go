@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+// detectorRun is how one detector did over a video.
+type detectorRun struct {
+	name   string
+	det    faceDetector
+	faces  int
+	frames int // frames with at least one face
+	spent  time.Duration
+}
+
+// compareFaceDetectors runs the Haar and SSD detectors over every frame of
+// the video at path. For the frames where they disagree, and in total, it
+// prints how many faces each found and how many of them both agreed on. Both
+// detectors use cfg apart from its backend.
+func compareFaceDetectors(path string, cfg detectConfig) error {
+	video, err := gocv.VideoCaptureFile(path)
+	if err != nil {
+		return fmt.Errorf("error opening video file: %v", path)
+	}
+	defer video.Close()
+
+	var runs []*detectorRun
+	for _, backend := range []string{"haar", "ssd"} {
+		c := cfg
+		c.Backend = backend
+		det, err := newFaceDetector(c)
+		if err != nil {
+			return err
+		}
+		defer det.Close()
+		runs = append(runs, &detectorRun{name: backend, det: det})
+	}
+
+	img := gocv.NewMat()
+	defer img.Close()
+
+	var frames, agreed int
+	fmt.Println("frame\thaar\tssd\tagreed")
+	for video.Read(&img) && !img.Empty() {
+		frames++
+
+		found := make([][]image.Rectangle, len(runs))
+		for i, r := range runs {
+			start := time.Now()
+			found[i] = r.det.Detect(img)
+			r.spent += time.Since(start)
+			r.faces += len(found[i])
+			if len(found[i]) > 0 {
+				r.frames++
+			}
+		}
+
+		same := matchingFaces(found[0], found[1])
+		agreed += same
+		if len(found[0]) != len(found[1]) || same != len(found[0]) {
+			fmt.Printf("%d\t%d\t%d\t%d\n", frames, len(found[0]), len(found[1]), same)
+		}
+	}
+	if frames == 0 {
+		return fmt.Errorf("no frames in %v", path)
+	}
+
+	fmt.Printf("\n%d frames, %d faces found by both\n", frames, agreed)
+	for _, r := range runs {
+		fmt.Printf("%s:\t%d faces, faces in %d frames, %.1f ms per frame\n",
+			r.name, r.faces, r.frames, float64(r.spent)/float64(time.Millisecond)/float64(frames))
+	}
+	return nil
+}
+
+// matchingFaces counts the faces in a that overlap a face in b by at least
+// half, matching each face in b at most once.
+func matchingFaces(a, b []image.Rectangle) int {
+	used := make([]bool, len(b))
+	var n int
+	for _, ra := range a {
+		for j, rb := range b {
+			if !used[j] && iou(ra, rb) >= 0.5 {
+				used[j] = true
+				n++
+				break
+			}
+		}
+	}
+	return n
+}
@@ -0,0 +1,936 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"math"
+	"os"
+	"time"
+)
+
+// config is the kiosk's JSON configuration file. Everything has a default, so
+// the kiosk runs without one: a single webcam whose default pipeline detects
+// faces on every frame and checks their quality and position before
+// recognition. Tracking is off unless a camera configures it, since it needs
+// a build with OpenCV contrib.
+type config struct {
+	// Source is the single camera used when Cameras is empty.
+	Source      sourceConfig      `json:"source"`
+	Cameras     []cameraConfig    `json:"cameras"`
+	Supervisor  supervisorConfig  `json:"supervisor"`
+	Clips       clipConfig        `json:"clips"`
+	Recognition recognitionConfig `json:"recognition"`
+	Occupancy   occupancyConfig   `json:"occupancy"`
+}
+
+// cameraConfig declares one named camera. Its ID is used in routes such as
+// /camera/{id} and in the events it produces.
+type cameraConfig struct {
+	ID        string          `json:"id"`
+	Source    sourceConfig    `json:"source"`
+	Width     int             `json:"width"`
+	Height    int             `json:"height"`
+	Capture   captureConfig   `json:"capture"`
+	Transform transformConfig `json:"transform"`
+	Enhance   enhancePaths    `json:"enhance"`
+	Tamper    tamperConfig    `json:"tamper"`
+	Pipeline  *pipelineConfig `json:"pipeline"`
+	Track     *trackConfig    `json:"track"`
+	Checkin   checkinConfig   `json:"checkin"`
+	Approach  approachConfig  `json:"approach"`
+	Align     alignConfig     `json:"align"`
+	Guidance  guidanceConfig  `json:"guidance"`
+	Confirm   confirmConfig   `json:"confirm"`
+	Liveness  livenessConfig  `json:"liveness"`
+	Privacy   privacyConfig   `json:"privacy"`
+}
+
+// privacyConfig hides the faces on some of a camera's outputs, such as the
+// raw stream shown on a lobby screen. Method is "blur" or "pixelate", and
+// Margin grows each face by a fraction of its width first. With
+// KeepCheckingIn the face of the student last checked in stays clear for
+// KeepFor seconds. Recognition always works on the clear frame.
+type privacyConfig struct {
+	Outputs        []string `json:"outputs"`
+	Method         string   `json:"method"`
+	Blocks         int      `json:"blocks"`
+	Margin         float64  `json:"margin"`
+	KeepCheckingIn bool     `json:"keep_checking_in"`
+	KeepFor        float64  `json:"keep_for"`
+}
+
+func (c privacyConfig) method() string {
+	if c.Method == "" {
+		return "blur"
+	}
+	return c.Method
+}
+
+func (c privacyConfig) blocks() int {
+	if c.Blocks <= 0 {
+		return 8
+	}
+	return c.Blocks
+}
+
+func (c privacyConfig) margin() float64        { return orDefault(c.Margin, 0.2) }
+func (c privacyConfig) keepFor() time.Duration { return seconds(c.KeepFor, 10) }
+
+// hides reports whether the output's faces are hidden.
+func (c privacyConfig) hides(output string) bool {
+	for _, o := range c.Outputs {
+		if o == output {
+			return true
+		}
+	}
+	return false
+}
+
+// alignConfig configures the align stage, which finds the eyes of each face
+// with EyeCascade. Faces tilted more than MaxAngle degrees are left unaligned.
+type alignConfig struct {
+	EyeCascade string  `json:"eye_cascade"`
+	MaxAngle   float64 `json:"max_angle"`
+}
+
+func (c alignConfig) maxAngle() float64 { return orDefault(c.MaxAngle, 30) }
+
+func (c alignConfig) eyeCascade() string {
+	if c.EyeCascade == "" {
+		return eyeAlgorithm
+	}
+	return c.EyeCascade
+}
+
+// approachConfig configures the approach classifier, which tells students
+// walking up to the kiosk from people walking past. A face is approaching when
+// it grew by MinGrowth over the last Window seconds or the optical flow
+// around it expands by MinExpansion of its width per frame. It is engaged
+// once it has been at least MinSize pixels wide and moved sideways less than
+// MaxLateral of its width per frame for Dwell seconds.
+type approachConfig struct {
+	Window       float64 `json:"window"`
+	MinGrowth    float64 `json:"min_growth"`
+	MinExpansion float64 `json:"min_expansion"`
+	MaxLateral   float64 `json:"max_lateral"`
+	Dwell        float64 `json:"dwell"`
+	MinSize      int     `json:"min_size"`
+}
+
+func (c approachConfig) window() time.Duration { return seconds(c.Window, 2) }
+func (c approachConfig) minGrowth() float64    { return orDefault(c.MinGrowth, 1.15) }
+func (c approachConfig) minExpansion() float64 { return orDefault(c.MinExpansion, 0.005) }
+func (c approachConfig) maxLateral() float64   { return orDefault(c.MaxLateral, 0.03) }
+func (c approachConfig) dwell() time.Duration  { return seconds(c.Dwell, 1) }
+
+func (c approachConfig) minSize() int {
+	if c.MinSize <= 0 {
+		return 90
+	}
+	return c.MinSize
+}
+
+// guidanceConfig configures the prompts that tell a student how to get into
+// position. Sizes are fractions of the frame width: a face narrower than
+// MinSize should step closer and one wider than MaxSize step back. A face
+// whose centre is more than MaxOffset of half the frame from the middle
+// should move towards it, and one within Edge of the border is partly out of
+// the frame. A prompt must hold for Frames frames before it is shown. With
+// Speak the prompts can be fetched as audio.
+type guidanceConfig struct {
+	MinSize   float64 `json:"min_size"`
+	MaxSize   float64 `json:"max_size"`
+	MaxOffset float64 `json:"max_offset"`
+	Edge      float64 `json:"edge"`
+	Frames    int     `json:"frames"`
+	Speak     bool    `json:"speak"`
+}
+
+func (c guidanceConfig) minSize() float64   { return orDefault(c.MinSize, 0.12) }
+func (c guidanceConfig) maxSize() float64   { return orDefault(c.MaxSize, 0.6) }
+func (c guidanceConfig) maxOffset() float64 { return orDefault(c.MaxOffset, 0.4) }
+func (c guidanceConfig) edge() float64      { return orDefault(c.Edge, 0.01) }
+
+func (c guidanceConfig) frames() int {
+	if c.Frames <= 0 {
+		return 5
+	}
+	return c.Frames
+}
+
+// confirmConfig asks students recognized with a confidence below Below to
+// confirm who they are with a hand gesture instead of checking them in
+// straight away; zero turns it off. Matches below Above are too unsure to
+// ask about and are dropped. A thumbs-up or one finger held up for
+// Frames frames in a row within Window seconds confirms, an open palm
+// rejects.
+// Skin is found between SkinLow and SkinHigh, as Y, Cr and Cb, and a hand
+// must cover MinArea of the frame.
+type confirmConfig struct {
+	Below    float64    `json:"below"`
+	Above    float64    `json:"above"`
+	Window   float64    `json:"window"`
+	Frames   int        `json:"frames"`
+	SkinLow  [3]float64 `json:"skin_low"`
+	SkinHigh [3]float64 `json:"skin_high"`
+	MinArea  float64    `json:"min_area"`
+}
+
+func (c confirmConfig) enabled() bool            { return c.Below > 0 }
+func (c confirmConfig) window() time.Duration    { return seconds(c.Window, 8) }
+func (c confirmConfig) minArea() float64         { return orDefault(c.MinArea, 0.01) }
+func (c confirmConfig) above() float64           { return orDefault(c.Above, 0.3) }
+func (c confirmConfig) needed(conf float64) bool { return c.enabled() && conf < c.Below }
+func (c confirmConfig) unsure(conf float64) bool { return c.enabled() && conf < c.above() }
+
+func (c confirmConfig) frames() int {
+	if c.Frames <= 0 {
+		return 5
+	}
+	return c.Frames
+}
+
+func (c confirmConfig) skinLow() [3]float64 {
+	if c.SkinLow == [3]float64{} {
+		return [3]float64{0, 133, 77}
+	}
+	return c.SkinLow
+}
+
+func (c confirmConfig) skinHigh() [3]float64 {
+	if c.SkinHigh == [3]float64{} {
+		return [3]float64{255, 173, 127}
+	}
+	return c.SkinHigh
+}
+
+// livenessConfig configures the liveness check that tells a student from a
+// photo or screen held up to the camera. Policy is "off", "warn" (results
+// carry the liveness score but check-ins go ahead) or "block" (faces that
+// fail are not checked in). A face is live when its score, from 0 to 1, is at
+// least Threshold, judged over the last Window seconds. MotionRef is the
+// spread of optical flow across the face, in pixels per frame, that counts
+// as fully natural movement. Sharpness between MinTexture and MaxTexture
+// looks like skin; below looks like a print and above like a screen.
+type livenessConfig struct {
+	Policy     string  `json:"policy"`
+	Threshold  float64 `json:"threshold"`
+	Window     float64 `json:"window"`
+	MotionRef  float64 `json:"motion_ref"`
+	MinTexture float64 `json:"min_texture"`
+	MaxTexture float64 `json:"max_texture"`
+	EyeCascade string  `json:"eye_cascade"`
+}
+
+func (c livenessConfig) policy() string {
+	if c.Policy == "" {
+		return "off"
+	}
+	return c.Policy
+}
+
+func (c livenessConfig) threshold() float64    { return orDefault(c.Threshold, 0.5) }
+func (c livenessConfig) window() time.Duration { return seconds(c.Window, 4) }
+func (c livenessConfig) motionRef() float64    { return orDefault(c.MotionRef, 0.3) }
+func (c livenessConfig) minTexture() float64   { return orDefault(c.MinTexture, 20) }
+func (c livenessConfig) maxTexture() float64   { return orDefault(c.MaxTexture, 1500) }
+
+func (c livenessConfig) eyeCascade() string {
+	if c.EyeCascade == "" {
+		return eyeAlgorithm
+	}
+	return c.EyeCascade
+}
+
+// checkinConfig picks how students check in at a camera: "manual" through
+// /face, "auto" when a face holds still in front of the kiosk, or "both".
+// An auto check-in fires once a face at least MinSize pixels wide has moved
+// less than MaxMove of its width per frame for Frames frames. The same
+// student isn't checked in again for IdentityCooldown seconds, and nobody
+// standing in the same place triggers recognition again for
+// PositionCooldown seconds.
+type checkinConfig struct {
+	Mode             string  `json:"mode"`
+	Frames           int     `json:"frames"`
+	MaxMove          float64 `json:"max_move"`
+	MinSize          int     `json:"min_size"`
+	IdentityCooldown float64 `json:"identity_cooldown"`
+	PositionCooldown float64 `json:"position_cooldown"`
+}
+
+func (c checkinConfig) mode() string {
+	if c.Mode == "" {
+		return "manual"
+	}
+	return c.Mode
+}
+
+func (c checkinConfig) manual() bool { return c.mode() != "auto" }
+func (c checkinConfig) auto() bool   { return c.mode() != "manual" }
+
+func (c checkinConfig) frames() int {
+	if c.Frames <= 0 {
+		return 10
+	}
+	return c.Frames
+}
+
+func (c checkinConfig) minSize() int {
+	if c.MinSize <= 0 {
+		return 100
+	}
+	return c.MinSize
+}
+
+func (c checkinConfig) maxMove() float64                { return orDefault(c.MaxMove, 0.1) }
+func (c checkinConfig) identityCooldown() time.Duration { return seconds(c.IdentityCooldown, 60) }
+func (c checkinConfig) positionCooldown() time.Duration { return seconds(c.PositionCooldown, 10) }
+
+// pipelineConfig lists the stages every frame goes through. Stages run in
+// order on the analysed frame, which is what recognition sees, then each
+// output renders its own copy of the captured frame and is served at
+// /camera/{id}/{output}. The "raw" output is also served at /camera/{id}.
+//
+//	{"stages": [{"type": "enhance", "equalize": "clahe"}],
+//	 "outputs": {"raw": [{"type": "encode"}],
+//	             "annotated": [{"type": "overlay"}, {"type": "encode"}]}}
+type pipelineConfig struct {
+	Stages  []stageConfig            `json:"stages"`
+	Outputs map[string][]stageConfig `json:"outputs"`
+}
+
+// stageConfig names a stage type and keeps the whole object so the stage's
+// factory can read its own settings from it.
+type stageConfig struct {
+	Type string `json:"type"`
+	Name string `json:"name"`
+	raw  json.RawMessage
+}
+
+func (c *stageConfig) UnmarshalJSON(data []byte) error {
+	type plain stageConfig
+	if err := json.Unmarshal(data, (*plain)(c)); err != nil {
+		return err
+	}
+	c.raw = append(json.RawMessage(nil), data...)
+	return nil
+}
+
+// label is the stage's name in metrics and logs.
+func (c stageConfig) label() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return c.Type
+}
+
+// newStageConfig builds the config of a stage of type typ with the settings in params.
+func newStageConfig(typ string, params interface{}) stageConfig {
+	raw := []byte("{}")
+	if params != nil {
+		raw, _ = json.Marshal(params)
+	}
+	return stageConfig{Type: typ, raw: raw}
+}
+
+// pipeline returns the camera's pipeline. Without one in the config it
+// builds the default: the recognition enhancement, face detection on every
+// frame, or on every fifth with tracking in between if the camera has a track
+// config, face quality, eye alignment, guidance and, if enabled, liveness,
+// approach, automatic check-in and gesture confirmation as the shared
+// stages, and raw and annotated outputs that apply the display enhancement.
+// Outputs listed under privacy hide faces first thing.
+func (c cameraConfig) pipeline() pipelineConfig {
+	var p pipelineConfig
+	if c.Pipeline != nil {
+		p = *c.Pipeline
+	} else {
+		p = c.defaultPipeline()
+	}
+
+	outputs := map[string][]stageConfig{"raw": {newStageConfig("encode", nil)}}
+	for name, stages := range p.Outputs {
+		outputs[name] = stages
+	}
+	for name, stages := range outputs {
+		if c.Privacy.hides(name) {
+			outputs[name] = append([]stageConfig{newStageConfig("privacy", c.Privacy)}, stages...)
+		}
+	}
+	p.Outputs = outputs
+	return p
+}
+
+func (c cameraConfig) defaultPipeline() pipelineConfig {
+	stages := []stageConfig{newStageConfig("enhance", c.Enhance.Recognition)}
+	if c.Track != nil {
+		stages = append(stages, newStageConfig("detect", detectConfig{Every: 5}), newStageConfig("track", c.Track))
+	} else {
+		stages = append(stages, newStageConfig("detect", nil))
+	}
+	stages = append(stages,
+		newStageConfig("quality", nil),
+		newStageConfig("align", c.Align),
+		newStageConfig("guidance", c.Guidance),
+	)
+	if c.Liveness.policy() != "off" {
+		stages = append(stages, newStageConfig("liveness", c.Liveness))
+	}
+	if c.Checkin.auto() {
+		stages = append(stages, newStageConfig("approach", c.Approach), newStageConfig("autocheckin", c.Checkin))
+	}
+	if c.Confirm.enabled() {
+		stages = append(stages, newStageConfig("gesture", c.Confirm))
+	}
+
+	display := newStageConfig("enhance", c.Enhance.Display)
+	return pipelineConfig{
+		Stages: stages,
+		Outputs: map[string][]stageConfig{
+			"raw":       {display, newStageConfig("encode", nil)},
+			"annotated": {display, newStageConfig("overlay", nil), newStageConfig("encode", nil)},
+		},
+	}
+}
+
+// tamperConfig turns on tamper detection for a camera. The baseline is
+// learned LearnAfter seconds after start, a frame is checked every Interval
+// seconds, and a tamper state must last Hold seconds before it is reported.
+// CoveredStdDev is the brightness spread below which the lens counts as
+// covered, DefocusRatio the fraction of the baseline sharpness below which
+// it counts as defocused, and MinMatchRatio and MaxShift (a fraction of the
+// frame width) decide when it has been moved. Webhook, if set, is POSTed
+// every tamper event.
+type tamperConfig struct {
+	Enabled       bool    `json:"enabled"`
+	Interval      float64 `json:"interval"`
+	LearnAfter    float64 `json:"learn_after"`
+	Hold          float64 `json:"hold"`
+	CoveredStdDev float64 `json:"covered_stddev"`
+	DefocusRatio  float64 `json:"defocus_ratio"`
+	MinMatchRatio float64 `json:"min_match_ratio"`
+	MaxShift      float64 `json:"max_shift"`
+	Webhook       string  `json:"webhook"`
+}
+
+func (c tamperConfig) interval() time.Duration   { return seconds(c.Interval, 1) }
+func (c tamperConfig) learnAfter() time.Duration { return seconds(c.LearnAfter, 5) }
+func (c tamperConfig) hold() time.Duration       { return seconds(c.Hold, 10) }
+func (c tamperConfig) coveredStdDev() float64    { return orDefault(c.CoveredStdDev, 8) }
+func (c tamperConfig) defocusRatio() float64     { return orDefault(c.DefocusRatio, 0.3) }
+func (c tamperConfig) minMatchRatio() float64    { return orDefault(c.MinMatchRatio, 0.15) }
+func (c tamperConfig) maxShift() float64         { return orDefault(c.MaxShift, 0.08) }
+
+// motionConfig configures the motion gate stage. Threshold is the fraction
+// of the frame that has to be foreground to count as motion. After IdleAfter
+// seconds without motion the gate only lets IdleFPS frames a second through.
+type motionConfig struct {
+	Algorithm string  `json:"algorithm"` // "mog2" or "knn"
+	Threshold float64 `json:"threshold"`
+	IdleAfter float64 `json:"idle_after"`
+	IdleFPS   float64 `json:"idle_fps"`
+	Width     int     `json:"width"`
+}
+
+func (c motionConfig) threshold() float64       { return orDefault(c.Threshold, 0.01) }
+func (c motionConfig) idleAfter() time.Duration { return seconds(c.IdleAfter, 10) }
+func (c motionConfig) idleInterval() time.Duration {
+	return time.Duration(float64(time.Second) / orDefault(c.IdleFPS, 1))
+}
+func (c motionConfig) width() int {
+	if c.Width <= 0 {
+		return 320
+	}
+	return c.Width
+}
+
+// detectSettings returns the settings of the default camera's first shared
+// detect stage, for tools that run a detector outside the pipeline.
+func (c *config) detectSettings() detectConfig {
+	var dc detectConfig
+	for _, sc := range c.cameras()[0].pipeline().Stages {
+		if sc.Type == "detect" {
+			json.Unmarshal(sc.raw, &dc)
+			break
+		}
+	}
+	return dc
+}
+
+// detectConfig configures the face detection stage. Backend is "haar" or
+// "ssd". Haar frames are scaled down to Width pixels before detection; MinSize
+// and MaxSize are face widths in pixels of the full frame, with 0 meaning no
+// limit on the maximum. The SSD keeps faces it is at least Confidence sure of
+// and drops any overlapping a better one by more than NMS (intersection over
+// union).
+type detectConfig struct {
+	Backend      string  `json:"backend"`
+	Cascade      string  `json:"cascade"`
+	Prototxt     string  `json:"prototxt"`
+	Model        string  `json:"model"`
+	Confidence   float64 `json:"confidence"`
+	NMS          float64 `json:"nms"`
+	ScaleFactor  float64 `json:"scale_factor"`
+	MinNeighbors int     `json:"min_neighbors"`
+	MinSize      int     `json:"min_size"`
+	MaxSize      int     `json:"max_size"`
+	Width        int     `json:"width"`
+	Every        int     `json:"every"`
+}
+
+// every is how often detection runs, in frames. A track stage follows the
+// faces on the frames in between.
+func (c detectConfig) every() int {
+	if c.Every <= 0 {
+		return 1
+	}
+	return c.Every
+}
+
+func (c detectConfig) cascade() string {
+	if c.Cascade == "" {
+		return faceAlgorithm
+	}
+	return c.Cascade
+}
+
+func (c detectConfig) prototxt() string {
+	if c.Prototxt == "" {
+		return "deploy.prototxt"
+	}
+	return c.Prototxt
+}
+
+func (c detectConfig) model() string {
+	if c.Model == "" {
+		return "res10_300x300_ssd_iter_140000.caffemodel"
+	}
+	return c.Model
+}
+
+func (c detectConfig) scaleFactor() float64 { return orDefault(c.ScaleFactor, 1.1) }
+func (c detectConfig) confidence() float64  { return orDefault(c.Confidence, 0.5) }
+func (c detectConfig) nms() float64         { return orDefault(c.NMS, 0.4) }
+
+func (c detectConfig) minNeighbors() int {
+	if c.MinNeighbors <= 0 {
+		return 3
+	}
+	return c.MinNeighbors
+}
+
+func (c detectConfig) minSize() int {
+	if c.MinSize <= 0 {
+		return 60
+	}
+	return c.MinSize
+}
+
+func (c detectConfig) width() int {
+	if c.Width <= 0 {
+		return 640
+	}
+	return c.Width
+}
+
+// trackConfig configures the face tracker. Algorithm is the contrib tracker
+// that follows faces between detections: "kcf", "mil" or "medianflow". A
+// detection continues a track when they overlap by MatchIoU, and a track is
+// lost after LostAfter seconds without matching a detection, however well
+// the tracker still follows it. A face facebox didn't know
+// is tried again after RetryUnknown seconds.
+type trackConfig struct {
+	Algorithm    string  `json:"algorithm"`
+	MatchIoU     float64 `json:"match_iou"`
+	LostAfter    float64 `json:"lost_after"`
+	RetryUnknown float64 `json:"retry_unknown"`
+}
+
+func (c trackConfig) matchIoU() float64           { return orDefault(c.MatchIoU, 0.3) }
+func (c trackConfig) lostAfter() time.Duration    { return seconds(c.LostAfter, 1) }
+func (c trackConfig) retryUnknown() time.Duration { return seconds(c.RetryUnknown, 5) }
+
+// qualityConfig sets what a face needs before it is sent to recognition.
+// MinSize is the face width in pixels of the full frame. Sharpness, brightness
+// and contrast are measured on the face scaled to 128x128 gray pixels.
+// MinEyes is how many eyes EyeCascade has to find for the face to count as
+// frontal; 0 turns the check off.
+type qualityConfig struct {
+	MinSize       int     `json:"min_size"`
+	MinSharpness  float64 `json:"min_sharpness"`
+	MinBrightness float64 `json:"min_brightness"`
+	MaxBrightness float64 `json:"max_brightness"`
+	MinContrast   float64 `json:"min_contrast"`
+	MinEyes       *int    `json:"min_eyes"`
+	EyeCascade    string  `json:"eye_cascade"`
+}
+
+func (c qualityConfig) minSize() int {
+	if c.MinSize <= 0 {
+		return 80
+	}
+	return c.MinSize
+}
+
+func (c qualityConfig) minSharpness() float64  { return orDefault(c.MinSharpness, 50) }
+func (c qualityConfig) minBrightness() float64 { return orDefault(c.MinBrightness, 60) }
+func (c qualityConfig) maxBrightness() float64 { return orDefault(c.MaxBrightness, 210) }
+func (c qualityConfig) minContrast() float64   { return orDefault(c.MinContrast, 25) }
+
+func (c qualityConfig) minEyes() int {
+	if c.MinEyes == nil {
+		return 2
+	}
+	return *c.MinEyes
+}
+
+func (c qualityConfig) eyeCascade() string {
+	if c.EyeCascade == "" {
+		return eyeAlgorithm
+	}
+	return c.EyeCascade
+}
+
+// enhancePaths configures image enhancement separately for what the kiosk
+// displays and for what it sends to facebox, so recognition can get a
+// heavily corrected frame while the display stays natural. It only applies
+// to the default pipeline; a configured pipeline uses enhance stages instead.
+type enhancePaths struct {
+	Display     enhanceConfig `json:"display"`
+	Recognition enhanceConfig `json:"recognition"`
+}
+
+// enhanceConfig turns on the enhancement steps. Gamma above 1 brightens and
+// below 1 darkens; 0 or 1 is off. Equalize is "", "hist" or "clahe" and works
+// on the luminance channel only.
+type enhanceConfig struct {
+	WhiteBalance bool    `json:"white_balance"`
+	Equalize     string  `json:"equalize"`
+	ClipLimit    float64 `json:"clip_limit"`
+	Tiles        int     `json:"tiles"`
+	Gamma        float64 `json:"gamma"`
+}
+
+func (c enhanceConfig) clipLimit() float64 {
+	if c.ClipLimit <= 0 {
+		return 2
+	}
+	return c.ClipLimit
+}
+
+func (c enhanceConfig) tiles() int {
+	if c.Tiles <= 0 {
+		return 8
+	}
+	return c.Tiles
+}
+
+// captureConfig holds the properties set on the device through
+// VideoCapture.Set. Unset properties keep the device defaults. Exposure and
+// focus values are driver specific; on V4L an auto_exposure of 0.25 selects
+// manual exposure and 0.75 automatic.
+type captureConfig struct {
+	FPS          float64  `json:"fps"`
+	AutoExposure *float64 `json:"auto_exposure"`
+	Exposure     *float64 `json:"exposure"`
+	AutoFocus    *bool    `json:"autofocus"`
+	Focus        *float64 `json:"focus"`
+}
+
+// transformConfig is applied to every captured frame, in the order rotate
+// (clockwise degrees), mirror, crop. The crop is in the coordinates of the
+// rotated frame.
+type transformConfig struct {
+	Mirror bool        `json:"mirror"`
+	Rotate int         `json:"rotate"`
+	Crop   *rectConfig `json:"crop"`
+}
+
+// rectConfig is a rectangle in pixels.
+type rectConfig struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+func (r rectConfig) rect() image.Rectangle {
+	return image.Rect(r.X, r.Y, r.X+r.Width, r.Y+r.Height)
+}
+
+// cameras returns the configured cameras, or a single "default" camera built
+// from Source when none are declared.
+func (c *config) cameras() []cameraConfig {
+	if len(c.Cameras) > 0 {
+		return c.Cameras
+	}
+	return []cameraConfig{{ID: "default", Source: c.Source}}
+}
+
+// sourceConfig picks the FrameSource the capture goroutine reads from.
+//
+//	{"type": "device", "device": 0}
+//	{"type": "file", "path": "lobby.mp4", "loop": true}
+//	{"type": "url", "path": "http://10.0.0.7:8090/camera"}
+//	{"type": "dir", "path": "testdata/frames", "fps": 5, "loop": true}
+type sourceConfig struct {
+	Type   string  `json:"type"`
+	Device int     `json:"device"`
+	Path   string  `json:"path"`
+	FPS    float64 `json:"fps"`
+	Loop   bool    `json:"loop"`
+}
+
+// supervisorConfig tunes how the camera supervisor reconnects and when it
+// decides the camera has frozen. Times are in seconds.
+type supervisorConfig struct {
+	MinBackoff  float64 `json:"min_backoff"`
+	MaxBackoff  float64 `json:"max_backoff"`
+	ReadTimeout float64 `json:"read_timeout"`
+	StallAfter  float64 `json:"stall_after"`
+}
+
+func (c supervisorConfig) minBackoff() time.Duration  { return seconds(c.MinBackoff, 1) }
+func (c supervisorConfig) maxBackoff() time.Duration  { return seconds(c.MaxBackoff, 30) }
+func (c supervisorConfig) readTimeout() time.Duration { return seconds(c.ReadTimeout, 2) }
+func (c supervisorConfig) stallAfter() time.Duration  { return seconds(c.StallAfter, 10) }
+
+// recognitionConfig controls how /face recognizes the faces in a frame. Each
+// face is cropped with Margin (a fraction of its width) on every side and sent
+// to facebox on its own, at most Concurrency at a time. Policy picks who is
+// checked in: "largest", "centred" or "all".
+//
+// Faces the align stage found the eyes of are rotated so the eyes are level
+// and scaled so they are EyeDistance of the crop's width apart, at EyeHeight
+// from its top, in a Size pixel square crop. Enrollment uses the same crop,
+// so stored and live faces match.
+type recognitionConfig struct {
+	Margin      float64 `json:"margin"`
+	Concurrency int     `json:"concurrency"`
+	Policy      string  `json:"policy"`
+	Size        int     `json:"size"`
+	EyeDistance float64 `json:"eye_distance"`
+	EyeHeight   float64 `json:"eye_height"`
+}
+
+func (c recognitionConfig) size() int {
+	if c.Size <= 0 {
+		return 160
+	}
+	return c.Size
+}
+
+func (c recognitionConfig) eyeDistance() float64 { return orDefault(c.EyeDistance, 0.4) }
+func (c recognitionConfig) eyeHeight() float64   { return orDefault(c.EyeHeight, 0.38) }
+
+func (c recognitionConfig) margin() float64 { return orDefault(c.Margin, 0.3) }
+
+func (c recognitionConfig) concurrency() int {
+	if c.Concurrency <= 0 {
+		return 2
+	}
+	return c.Concurrency
+}
+
+func (c recognitionConfig) policy() string {
+	if c.Policy == "" {
+		return "largest"
+	}
+	return c.Policy
+}
+
+// occupancyConfig turns on people counting on the camera named Camera. Every
+// Interval seconds people are detected on the frame scaled to Width pixels
+// and followed from one detection to the next if they moved less than
+// MaxDistance of the frame width. Crossing Line towards Inside is an entry
+// and away from it an exit; both are fractions of the frame, and a Line needs
+// an Inside off it. A "crowd" event is raised when the count reaches Crowd,
+// if set.
+type occupancyConfig struct {
+	Camera       string       `json:"camera"`
+	Interval     float64      `json:"interval"`
+	Width        int          `json:"width"`
+	HitThreshold float64      `json:"hit_threshold"`
+	MaxDistance  float64      `json:"max_distance"`
+	LostAfter    float64      `json:"lost_after"`
+	Line         *lineConfig  `json:"line"`
+	Inside       *pointConfig `json:"inside"`
+	Crowd        int          `json:"crowd"`
+	HistoryHours int          `json:"history_hours"`
+}
+
+// lineConfig is a line across the frame, in fractions of its size.
+type lineConfig struct {
+	From pointConfig `json:"from"`
+	To   pointConfig `json:"to"`
+}
+
+type pointConfig struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+func (c occupancyConfig) interval() time.Duration  { return seconds(c.Interval, 0.5) }
+func (c occupancyConfig) maxDistance() float64     { return orDefault(c.MaxDistance, 0.1) }
+func (c occupancyConfig) lostAfter() time.Duration { return seconds(c.LostAfter, 2) }
+
+func (c occupancyConfig) width() int {
+	if c.Width <= 0 {
+		return 640
+	}
+	return c.Width
+}
+
+// line returns the counting line and a point inside the lobby. By default
+// the line runs down the middle of the frame and the lobby is on the right.
+func (c occupancyConfig) line() (lineConfig, pointConfig) {
+	if c.Line == nil {
+		return lineConfig{From: pointConfig{0.5, 0}, To: pointConfig{0.5, 1}}, pointConfig{1, 0.5}
+	}
+	return *c.Line, *c.Inside
+}
+
+// validate checks that the counting line, if set, can tell entries from
+// exits: it has to have a length, and the inside point has to be clearly on
+// one side of it once both are scaled to a frame.
+func (c occupancyConfig) validate() error {
+	if c.Line == nil {
+		return nil
+	}
+	if c.Inside == nil {
+		return fmt.Errorf("occupancy line needs an inside point")
+	}
+	from, to, in := c.Line.From, c.Line.To, *c.Inside
+	length := math.Hypot(to.X-from.X, to.Y-from.Y)
+	if length == 0 {
+		return fmt.Errorf("occupancy line has no length")
+	}
+	if d := ((to.X-from.X)*(in.Y-from.Y) - (to.Y-from.Y)*(in.X-from.X)) / length; math.Abs(d) < 0.01 {
+		return fmt.Errorf("occupancy inside point is on the line")
+	}
+	return nil
+}
+
+func (c occupancyConfig) historyHours() int {
+	if c.HistoryHours <= 0 {
+		return 7 * 24
+	}
+	return c.HistoryHours
+}
+
+// clipConfig controls the video clips recorded around each check-in. Clips
+// are recorded only when Dir is set. Before and After are in seconds, and the
+// oldest clips are deleted once the directory grows past QuotaMB. Clips are
+// of the captured frames, or of a camera output such as one that hides faces
+// if Output names it. They show students' faces, so they are only served on
+// Listen, a separate address for staff, and not at all without one.
+type clipConfig struct {
+	Dir     string  `json:"dir"`
+	Output  string  `json:"output"`
+	Listen  string  `json:"listen"`
+	Before  float64 `json:"before"`
+	After   float64 `json:"after"`
+	Codec   string  `json:"codec"`
+	FPS     float64 `json:"fps"`
+	QuotaMB int64   `json:"quota_mb"`
+}
+
+func (c clipConfig) before() time.Duration { return seconds(c.Before, 5) }
+func (c clipConfig) after() time.Duration  { return seconds(c.After, 5) }
+func (c clipConfig) quota() int64          { return c.QuotaMB * 1024 * 1024 }
+
+func (c clipConfig) codec() string {
+	if c.Codec == "" {
+		return "MJPG"
+	}
+	return c.Codec
+}
+
+func (c clipConfig) fps() float64 {
+	if c.FPS <= 0 {
+		return 10
+	}
+	return c.FPS
+}
+
+// seconds converts a config value in seconds to a duration, using def when unset.
+func seconds(v, def float64) time.Duration {
+	if v <= 0 {
+		v = def
+	}
+	return time.Duration(v * float64(time.Second))
+}
+
+// orDefault returns v, or def when v is unset.
+func orDefault(v, def float64) float64 {
+	if v <= 0 {
+		return def
+	}
+	return v
+}
+
+// loadConfig reads the config file at path, or returns the defaults when path is empty.
+func loadConfig(path string) (*config, error) {
+	cfg := &config{Source: sourceConfig{Type: "device"}}
+	if path == "" {
+		return cfg, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if err := json.NewDecoder(f).Decode(cfg); err != nil {
+		return nil, err
+	}
+	switch cfg.Recognition.policy() {
+	case "largest", "centred", "all":
+	default:
+		return nil, fmt.Errorf("unknown recognition policy %q", cfg.Recognition.Policy)
+	}
+	if err := cfg.Occupancy.validate(); err != nil {
+		return nil, err
+	}
+	for i, cc := range cfg.cameras() {
+		if cc.ID == "" {
+			return nil, fmt.Errorf("camera %d has no id", i)
+		}
+		switch cc.Checkin.mode() {
+		case "manual", "auto", "both":
+		default:
+			return nil, fmt.Errorf("camera %s: unknown check-in mode %q", cc.ID, cc.Checkin.Mode)
+		}
+		if cc.Guidance.maxSize() <= cc.Guidance.minSize() {
+			return nil, fmt.Errorf("camera %s: guidance max_size must be above min_size", cc.ID)
+		}
+		if cc.Track != nil && !trackingBuilt {
+			return nil, fmt.Errorf("camera %s: tracking needs OpenCV contrib; build the kiosk with -tags contrib", cc.ID)
+		}
+		if cc.Confirm.Below > 1 {
+			return nil, fmt.Errorf("camera %s: confirm below is a confidence from 0 to 1", cc.ID)
+		}
+		if cc.Confirm.enabled() && cc.Confirm.above() >= cc.Confirm.Below {
+			return nil, fmt.Errorf("camera %s: confirm above must be under below", cc.ID)
+		}
+		switch cc.Liveness.policy() {
+		case "off", "warn", "block":
+		default:
+			return nil, fmt.Errorf("camera %s: unknown liveness policy %q", cc.ID, cc.Liveness.Policy)
+		}
+		outputs := cc.pipeline().Outputs
+		for _, o := range cc.Privacy.Outputs {
+			if _, ok := outputs[o]; !ok {
+				return nil, fmt.Errorf("camera %s: no output %q to hide faces on", cc.ID, o)
+			}
+		}
+		if o := cfg.Clips.Output; o != "" && cfg.Clips.Dir != "" {
+			if _, ok := outputs[o]; !ok {
+				return nil, fmt.Errorf("camera %s: no output %q to record clips from", cc.ID, o)
+			}
+		}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"image"
+	"math"
+	"sort"
+
+	"gocv.io/x/gocv"
+)
+
+func init() {
+	RegisterProcessor("detect", newDetectStage)
+}
+
+// faceDetector finds faces in a BGR frame and returns them in pixels of that
+// frame.
+type faceDetector interface {
+	Detect(img gocv.Mat) []image.Rectangle
+	Close() error
+}
+
+// newFaceDetector builds the detector for cfg's backend.
+func newFaceDetector(cfg detectConfig) (faceDetector, error) {
+	if cfg.MaxSize > 0 && cfg.MaxSize < cfg.minSize() {
+		return nil, fmt.Errorf("max_size %d is below min_size %d", cfg.MaxSize, cfg.minSize())
+	}
+
+	switch cfg.Backend {
+	case "", "haar":
+		return newHaarDetector(cfg)
+	case "ssd":
+		return newSSDDetector(cfg)
+	}
+	return nil, fmt.Errorf("unknown detector backend %q", cfg.Backend)
+}
+
+// detectStage finds faces and stores them in ctx.Faces, where the overlay
+// draws them and later stages can crop them. It can run on only every few
+// frames, leaving a track stage to follow the faces in between.
+type detectStage struct {
+	det   faceDetector
+	every int
+	n     int
+}
+
+func newDetectStage(cam *camera, output string, params json.RawMessage) (Processor, error) {
+	var cfg detectConfig
+	if err := json.Unmarshal(params, &cfg); err != nil {
+		return nil, err
+	}
+	det, err := newFaceDetector(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &detectStage{det: det, every: cfg.every()}, nil
+}
+
+func (s *detectStage) Process(ctx *FrameContext) error {
+	s.n++
+	if (s.n-1)%s.every != 0 {
+		return nil
+	}
+	ctx.Faces = s.det.Detect(ctx.Image)
+	ctx.Detected = true
+	return nil
+}
+
+func (s *detectStage) Close() error {
+	return s.det.Close()
+}
+
+// haarDetector uses the Haar cascade shipped with the kiosk. Detection runs
+// on a scaled down gray copy of the frame, since the cascade is by far the
+// most expensive stage at full resolution.
+type haarDetector struct {
+	cfg     detectConfig
+	cascade gocv.CascadeClassifier
+}
+
+func newHaarDetector(cfg detectConfig) (*haarDetector, error) {
+	cascade := gocv.NewCascadeClassifier()
+	if !cascade.Load(cfg.cascade()) {
+		cascade.Close()
+		return nil, fmt.Errorf("error reading cascade file: %v", cfg.cascade())
+	}
+	return &haarDetector{cfg: cfg, cascade: cascade}, nil
+}
+
+func (d *haarDetector) Detect(img gocv.Mat) []image.Rectangle {
+	gray := toGray(img, d.cfg.width())
+	defer gray.Close()
+	if gray.Empty() {
+		return nil
+	}
+
+	// sizes are configured in full frame pixels
+	scale := float64(img.Cols()) / float64(gray.Cols())
+	minSize := scaledSize(d.cfg.minSize(), scale)
+	var maxSize image.Point
+	if d.cfg.MaxSize > 0 {
+		maxSize = scaledSize(d.cfg.MaxSize, scale)
+	}
+
+	rects := d.cascade.DetectMultiScaleWithParams(gray, d.cfg.scaleFactor(), d.cfg.minNeighbors(), 0, minSize, maxSize)
+	faces := make([]image.Rectangle, len(rects))
+	for i, r := range rects {
+		faces[i] = image.Rect(
+			int(float64(r.Min.X)*scale), int(float64(r.Min.Y)*scale),
+			int(float64(r.Max.X)*scale), int(float64(r.Max.Y)*scale),
+		)
+	}
+	return faces
+}
+
+func (d *haarDetector) Close() error {
+	return d.cascade.Close()
+}
+
+// ssdInput is the input size and ssdMean the per-channel mean the ResNet-10
+// SSD face model was trained with.
+var (
+	ssdInput = image.Pt(300, 300)
+	ssdMean  = gocv.NewScalar(104, 177, 123, 0)
+)
+
+// ssdDetector runs OpenCV's ResNet-10 SSD face model on the CPU. It copes
+// with turned and badly lit faces far better than Haar, at a higher cost.
+type ssdDetector struct {
+	cfg detectConfig
+	net gocv.Net
+}
+
+func newSSDDetector(cfg detectConfig) (*ssdDetector, error) {
+	net := gocv.ReadNetFromCaffe(cfg.prototxt(), cfg.model())
+	if net.Empty() {
+		net.Close()
+		return nil, fmt.Errorf("error reading network model from %v and %v", cfg.prototxt(), cfg.model())
+	}
+	return &ssdDetector{cfg: cfg, net: net}, nil
+}
+
+// scoredRect is a detection and how sure the detector is of it.
+type scoredRect struct {
+	rect  image.Rectangle
+	score float64
+}
+
+func (d *ssdDetector) Detect(img gocv.Mat) []image.Rectangle {
+	if img.Empty() {
+		return nil
+	}
+
+	blob := gocv.BlobFromImage(img, 1.0, ssdInput, ssdMean, false, false)
+	defer blob.Close()
+	d.net.SetInput(blob, "data")
+	out := d.net.Forward("detection_out")
+	defer out.Close()
+
+	// the output is 1x1xNx7 floats: image, class, confidence, then the box
+	// corners as fractions of the frame
+	data := out.ToBytes()
+	bounds := image.Rect(0, 0, img.Cols(), img.Rows())
+	var found []scoredRect
+	for i := 0; i+28 <= len(data); i += 28 {
+		v := func(n int) float64 {
+			return float64(math.Float32frombits(binary.LittleEndian.Uint32(data[i+4*n:])))
+		}
+		if v(2) < d.cfg.confidence() {
+			continue
+		}
+		r := image.Rect(
+			int(v(3)*float64(img.Cols())), int(v(4)*float64(img.Rows())),
+			int(v(5)*float64(img.Cols())), int(v(6)*float64(img.Rows())),
+		).Intersect(bounds)
+		if w := r.Dx(); w < d.cfg.minSize() || (d.cfg.MaxSize > 0 && w > d.cfg.MaxSize) {
+			continue
+		}
+		found = append(found, scoredRect{rect: r, score: v(2)})
+	}
+	return suppress(found, d.cfg.nms())
+}
+
+func (d *ssdDetector) Close() error {
+	return d.net.Close()
+}
+
+// suppress does non-maximum suppression: it keeps the best scored rectangles
+// and drops any that overlap a better one by more than threshold.
+func suppress(found []scoredRect, threshold float64) []image.Rectangle {
+	sort.Slice(found, func(i, j int) bool { return found[i].score > found[j].score })
+
+	var kept []image.Rectangle
+	for _, f := range found {
+		overlaps := false
+		for _, k := range kept {
+			if iou(f.rect, k) > threshold {
+				overlaps = true
+				break
+			}
+		}
+		if !overlaps {
+			kept = append(kept, f.rect)
+		}
+	}
+	return kept
+}
+
+// iou is the intersection over union of two rectangles.
+func iou(a, b image.Rectangle) float64 {
+	in := a.Intersect(b)
+	if in.Empty() {
+		return 0
+	}
+	inter := float64(in.Dx() * in.Dy())
+	union := float64(a.Dx()*a.Dy()+b.Dx()*b.Dy()) - inter
+	return inter / union
+}
+
+// scaledSize is a square of size full frame pixels in an image scaled down by scale.
+func scaledSize(size int, scale float64) image.Point {
+	n := int(float64(size) / scale)
+	return image.Pt(n, n)
+}
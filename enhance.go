@@ -0,0 +1,265 @@
+package main
+
+import (
+	"math"
+
+	"gocv.io/x/gocv"
+)
+
+// enhancer brightens and evens out frames from badly lit cameras, such as a
+// kiosk with a window behind the student. It applies, in order, gray-world
+// white balance, equalization of the luminance channel and gamma correction.
+// A nil enhancer leaves frames untouched.
+type enhancer struct {
+	cfg      enhanceConfig
+	gammaLUT gocv.Mat
+}
+
+// newEnhancer returns an enhancer for cfg, or nil when cfg enables nothing.
+func newEnhancer(cfg enhanceConfig) *enhancer {
+	if !cfg.WhiteBalance && cfg.Equalize == "" && (cfg.Gamma == 0 || cfg.Gamma == 1) {
+		return nil
+	}
+
+	// gammaLUT stays an empty Mat without gamma: Empty on a zero gocv.Mat
+	// dereferences a nil pointer.
+	e := &enhancer{cfg: cfg, gammaLUT: gocv.NewMat()}
+	if cfg.Gamma > 0 && cfg.Gamma != 1 {
+		lut := make([]byte, 256)
+		for i := range lut {
+			lut[i] = clampByte(255 * math.Pow(float64(i)/255, 1/cfg.Gamma))
+		}
+		if m, err := gocv.NewMatFromBytes(1, 256, gocv.MatTypeCV8UC1, lut); err == nil {
+			e.gammaLUT.Close()
+			e.gammaLUT = m
+		}
+	}
+	return e
+}
+
+// Close releases the gamma lookup table.
+func (e *enhancer) Close() error {
+	if e == nil {
+		return nil
+	}
+	return e.gammaLUT.Close()
+}
+
+// apply enhances the BGR image img in place.
+func (e *enhancer) apply(img *gocv.Mat) {
+	if e == nil || img.Empty() || img.Channels() != 3 {
+		return
+	}
+
+	if e.cfg.WhiteBalance {
+		grayWorld(img)
+	}
+
+	switch e.cfg.Equalize {
+	case "hist":
+		equalizeLuminance(img, equalizeHist)
+	case "clahe":
+		equalizeLuminance(img, func(y []byte, rows, cols int) []byte {
+			return clahe(y, rows, cols, e.cfg.clipLimit(), e.cfg.tiles())
+		})
+	}
+
+	if !e.gammaLUT.Empty() {
+		gocv.LUT(*img, e.gammaLUT, img)
+	}
+}
+
+// grayWorld scales each channel so that the image averages out to gray.
+func grayWorld(img *gocv.Mat) {
+	channels := gocv.Split(*img)
+	defer func() {
+		for _, c := range channels {
+			c.Close()
+		}
+	}()
+
+	means := make([]float64, len(channels))
+	var gray float64
+	for i, c := range channels {
+		means[i] = c.Mean().Val1
+		gray += means[i] / float64(len(channels))
+	}
+	for i, c := range channels {
+		if means[i] > 0 {
+			gocv.ConvertScaleAbs(c, &channels[i], gray/means[i], 0)
+		}
+	}
+	gocv.Merge(channels, img)
+}
+
+// equalizeLuminance runs eq over the Y channel of img in YCrCb, leaving the
+// colours alone.
+func equalizeLuminance(img *gocv.Mat, eq func(y []byte, rows, cols int) []byte) {
+	ycrcb := gocv.NewMat()
+	defer ycrcb.Close()
+	gocv.CvtColor(*img, &ycrcb, gocv.ColorBGRToYCrCb)
+
+	channels := gocv.Split(ycrcb)
+	defer func() {
+		for _, c := range channels {
+			c.Close()
+		}
+	}()
+
+	y := channels[0]
+	equalized, err := gocv.NewMatFromBytes(y.Rows(), y.Cols(), gocv.MatTypeCV8UC1, eq(y.ToBytes(), y.Rows(), y.Cols()))
+	if err != nil {
+		return
+	}
+	y.Close()
+	channels[0] = equalized
+
+	gocv.Merge(channels, &ycrcb)
+	gocv.CvtColor(ycrcb, img, gocv.ColorYCrCbToBGR)
+}
+
+// equalizeHist is global histogram equalization of an 8-bit channel. gocv
+// doesn't wrap cv::equalizeHist, so it is done here.
+func equalizeHist(px []byte, rows, cols int) []byte {
+	var hist [256]int
+	for _, p := range px {
+		hist[p]++
+	}
+	lut := cdfLUT(hist[:], len(px))
+
+	out := make([]byte, len(px))
+	for i, p := range px {
+		out[i] = lut[p]
+	}
+	return out
+}
+
+// cdfLUT maps a histogram of n pixels to its equalizing lookup table. A
+// histogram with a single value has nothing to spread, so its table is the
+// identity rather than mapping everything to black.
+func cdfLUT(hist []int, n int) [256]byte {
+	var cdf, cdfMin int
+	for _, h := range hist {
+		if h > 0 {
+			cdfMin = h
+			break
+		}
+	}
+
+	var lut [256]byte
+	for i, h := range hist {
+		if n <= cdfMin {
+			lut[i] = byte(i)
+			continue
+		}
+		cdf += h
+		lut[i] = clampByte(float64(cdf-cdfMin) * 255 / float64(n-cdfMin))
+	}
+	return lut
+}
+
+// clahe is contrast limited adaptive histogram equalization of an 8-bit
+// channel over a tiles×tiles grid, with each pixel's mapping interpolated
+// between its four nearest tiles. gocv doesn't wrap cv::CLAHE, so it is done
+// here.
+func clahe(px []byte, rows, cols int, clipLimit float64, tiles int) []byte {
+	if rows < tiles || cols < tiles {
+		return equalizeHist(px, rows, cols)
+	}
+	tileH, tileW := rows/tiles, cols/tiles
+
+	luts := make([][256]byte, tiles*tiles)
+	for ty := 0; ty < tiles; ty++ {
+		for tx := 0; tx < tiles; tx++ {
+			y0, x0 := ty*tileH, tx*tileW
+			y1, x1 := y0+tileH, x0+tileW
+			if ty == tiles-1 {
+				y1 = rows
+			}
+			if tx == tiles-1 {
+				x1 = cols
+			}
+
+			hist := make([]int, 256)
+			for y := y0; y < y1; y++ {
+				for _, p := range px[y*cols+x0 : y*cols+x1] {
+					hist[p]++
+				}
+			}
+			n := (y1 - y0) * (x1 - x0)
+
+			// clip the histogram and spread the excess evenly
+			limit := int(clipLimit * float64(n) / 256)
+			if limit < 1 {
+				limit = 1
+			}
+			excess := 0
+			for i, h := range hist {
+				if h > limit {
+					excess += h - limit
+					hist[i] = limit
+				}
+			}
+			for i := range hist {
+				hist[i] += excess / 256
+			}
+			for i := 0; i < excess%256; i++ {
+				hist[i*256/(excess%256)]++
+			}
+
+			var lut [256]byte
+			cdf := 0
+			for i, h := range hist {
+				cdf += h
+				lut[i] = clampByte(float64(cdf) * 255 / float64(n))
+			}
+			luts[ty*tiles+tx] = lut
+		}
+	}
+
+	out := make([]byte, len(px))
+	for y := 0; y < rows; y++ {
+		// position relative to tile centres
+		fy := (float64(y)+0.5)/float64(tileH) - 0.5
+		ty0 := clampInt(int(math.Floor(fy)), 0, tiles-1)
+		ty1 := clampInt(ty0+1, 0, tiles-1)
+		wy := clampFloat(fy-float64(ty0), 0, 1)
+
+		for x := 0; x < cols; x++ {
+			fx := (float64(x)+0.5)/float64(tileW) - 0.5
+			tx0 := clampInt(int(math.Floor(fx)), 0, tiles-1)
+			tx1 := clampInt(tx0+1, 0, tiles-1)
+			wx := clampFloat(fx-float64(tx0), 0, 1)
+
+			p := px[y*cols+x]
+			top := (1-wx)*float64(luts[ty0*tiles+tx0][p]) + wx*float64(luts[ty0*tiles+tx1][p])
+			bottom := (1-wx)*float64(luts[ty1*tiles+tx0][p]) + wx*float64(luts[ty1*tiles+tx1][p])
+			out[y*cols+x] = clampByte((1-wy)*top + wy*bottom)
+		}
+	}
+	return out
+}
+
+func clampByte(v float64) byte {
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return byte(v + 0.5)
+}
+
+func clampInt(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
+
+func clampFloat(v, lo, hi float64) float64 {
+	return math.Max(lo, math.Min(hi, v))
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// fill returns a rows×cols channel with pixel (x, y) set to f(x, y).
+func fill(rows, cols int, f func(x, y int) byte) []byte {
+	px := make([]byte, rows*cols)
+	for y := 0; y < rows; y++ {
+		for x := 0; x < cols; x++ {
+			px[y*cols+x] = f(x, y)
+		}
+	}
+	return px
+}
+
+func TestCDFLUT(t *testing.T) {
+	hist := make([]int, 256)
+	hist[10], hist[20], hist[30] = 1, 1, 2
+	lut := cdfLUT(hist, 4)
+	for v, want := range map[int]byte{10: 0, 15: 0, 20: 85, 25: 85, 30: 255, 200: 255} {
+		if lut[v] != want {
+			t.Errorf("cdfLUT maps %d to %d, want %d", v, lut[v], want)
+		}
+	}
+
+	flat := make([]int, 256)
+	flat[100] = 4
+	lut = cdfLUT(flat, 4)
+	for _, v := range []int{0, 100, 255} {
+		if lut[v] != byte(v) {
+			t.Errorf("cdfLUT of a single value maps %d to %d, want it unchanged", v, lut[v])
+		}
+	}
+}
+
+func TestEqualizeHist(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		want []byte
+	}{
+		{"flat", bytes.Repeat([]byte{100}, 16), bytes.Repeat([]byte{100}, 16)},
+		{"bimodal", []byte{50, 200, 50, 200, 50, 200, 50, 200}, []byte{0, 255, 0, 255, 0, 255, 0, 255}},
+		{"ramp", []byte{10, 20, 30, 40}, []byte{0, 85, 170, 255}},
+	}
+	for _, tt := range tests {
+		if got := equalizeHist(tt.in, 1, len(tt.in)); !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: equalizeHist(%v) = %v, want %v", tt.name, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestCLAHE(t *testing.T) {
+	// fewer rows or columns than tiles falls back to global equalization
+	small := []byte{50, 200, 50, 200, 50, 200}
+	if got, want := clahe(small, 1, 6, 2, 8), equalizeHist(small, 1, 6); !bytes.Equal(got, want) {
+		t.Errorf("clahe on 1×6 with 8 tiles = %v, want equalizeHist's %v", got, want)
+	}
+
+	// clipping keeps a flat picture close to where it was instead of
+	// stretching noise
+	flat := fill(32, 32, func(x, y int) byte { return 100 })
+	for i, p := range clahe(flat, 32, 32, 2, 4) {
+		if p < 90 || p > 115 {
+			t.Fatalf("clahe of a flat 100 picture gives %d at pixel %d, want about 100", p, i)
+		}
+	}
+
+	// bimodal with no clipping: the two values are pushed apart
+	bimodal := fill(16, 16, func(x, y int) byte {
+		if (x+y)%2 == 0 {
+			return 50
+		}
+		return 200
+	})
+	for i, p := range clahe(bimodal, 16, 16, 256, 2) {
+		if want := map[byte]byte{50: 128, 200: 255}[bimodal[i]]; p != want {
+			t.Fatalf("clahe of a bimodal picture maps %d to %d at pixel %d, want %d", bimodal[i], p, i, want)
+		}
+	}
+}
+
+func TestCLAHETileInterpolation(t *testing.T) {
+	// 128 sits on a checkerboard with 0 in the left tiles, where it maps to
+	// 255, and with 255 in the right tiles, where it maps to 128. Along a row
+	// its output must hold at each tile's value out to the tile centres and
+	// fall smoothly between them rather than jump at the tile boundary.
+	const rows, cols, tiles = 16, 16, 2
+	px := fill(rows, cols, func(x, y int) byte {
+		switch {
+		case (x+y)%2 == 0:
+			return 128
+		case x < cols/2:
+			return 0
+		default:
+			return 255
+		}
+	})
+	out := clahe(px, rows, cols, 256, tiles)
+
+	for y := 0; y < rows; y++ {
+		prev := -1
+		for x := y % 2; x < cols; x += 2 {
+			p := int(out[y*cols+x])
+			switch {
+			case x < 4 && p != 255:
+				t.Errorf("pixel (%d, %d) left of the left tile centre = %d, want 255", x, y, p)
+			case x > 11 && p != 128:
+				t.Errorf("pixel (%d, %d) right of the right tile centre = %d, want 128", x, y, p)
+			}
+			if prev >= 0 && (p > prev || prev-p > 40) {
+				t.Errorf("row %d goes from %d to %d at x=%d, want a steady fall", y, prev, p, x)
+			}
+			prev = p
+		}
+	}
+}
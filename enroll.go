@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"log"
+	"net/http"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+// enrollResult is the answer to /enroll.
+type enrollResult struct {
+	Name       string          `json:"name"`
+	ID         string          `json:"id"`
+	Camera     string          `json:"camera"`
+	Rect       image.Rectangle `json:"rect"`
+	Aligned    bool            `json:"aligned"`
+	AlignError string          `json:"align_error,omitempty"`
+}
+
+// enroll teaches facebox the student in front of a camera, from the same
+// aligned crop recognition sends, so the stored and live faces match.
+//
+//	POST /enroll?camera=lobby&name=Alex%20Smith&id=alex.smith
+func enroll(w http.ResponseWriter, r *http.Request) {
+
+	cam, ok := cameras.lookup(r)
+	if !ok {
+		http.Error(w, "unknown camera", http.StatusNotFound)
+		return
+	}
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		id = name
+	}
+
+	frame, err := cam.analyzed.Fresh(2 * time.Second)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer frame.Close()
+
+	face, reason := enrollmentFace(frame.Context)
+	if reason != "" {
+		http.Error(w, reason, http.StatusUnprocessableEntity)
+		return
+	}
+
+	fc := frame.Context.faceCrops([]image.Rectangle{face})[0]
+	crop, aligned, alignError := recognizer.normalizedCrop(frame.Mat, fc)
+	buf, err := gocv.IMEncode(".jpg", crop)
+	crop.Close()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := fbox.Teach(bytes.NewReader(buf), id, name); err != nil {
+		log.Printf("unable to teach facebox %s: %v", name, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	log.Printf("enrolled %s from camera %s, aligned %t", name, cam.id, aligned)
+
+	res := enrollResult{Name: name, ID: id, Camera: cam.id, Rect: face, Aligned: aligned, AlignError: alignError}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// enrollmentFace picks the face to enroll: the best face that passed the
+// quality stage, or the largest face if there is no quality stage. Otherwise
+// it says what is wrong.
+func enrollmentFace(ctx *FrameContext) (image.Rectangle, string) {
+	if q := ctx.Quality; q != nil {
+		if fq, ok := q.best(); ok {
+			return fq.Rect, ""
+		}
+		return image.Rectangle{}, q.Reason
+	}
+
+	var largest image.Rectangle
+	for _, f := range ctx.Faces {
+		if f.Dx() > largest.Dx() {
+			largest = f
+		}
+	}
+	if largest.Empty() {
+		return largest, reasonNoFace
+	}
+	return largest, ""
+}
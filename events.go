@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// event is something the kiosk tells the front end and reports about, such
+// as a student checking in at one of the cameras.
+type event struct {
+	ID     string      `json:"id"`
+	Type   string      `json:"type"`
+	Camera string      `json:"camera,omitempty"`
+	Time   time.Time   `json:"time"`
+	Data   interface{} `json:"data,omitempty"`
+}
+
+// checkinEvent is the data of a "checkin" event.
+type checkinEvent struct {
+	Student   string `json:"student"`
+	Counselor string `json:"counselor"`
+	// Rect is where the student's face was in the frame.
+	Rect image.Rectangle `json:"rect"`
+	// Auto is set when the kiosk checked the student in by itself.
+	Auto bool `json:"auto,omitempty"`
+	// Confirmed is set when the student confirmed who they are with a
+	// gesture.
+	Confirmed bool `json:"confirmed,omitempty"`
+	// Liveness is the face's liveness, if the camera checks it.
+	Liveness *livenessResult `json:"liveness,omitempty"`
+}
+
+// clipEvent is the data of a "clip" event, raised once the video around an
+// event has been written.
+type clipEvent struct {
+	// Event is the ID of the event the clip was recorded for.
+	Event string `json:"event"`
+	// Clip is the path the clip is served at.
+	Clip string `json:"clip"`
+}
+
+// eventHub fans events out to every connected /events client.
+type eventHub struct {
+	lock sync.Mutex
+	m    map[chan event]bool
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{m: make(map[chan event]bool)}
+}
+
+// newEventID returns a random ID for an event.
+func newEventID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// publish stamps e with an ID and time if it has none and sends it to every
+// subscriber. It returns the stamped event.
+func (h *eventHub) publish(e event) event {
+	if e.ID == "" {
+		e.ID = newEventID()
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	log.Printf("event %s %s camera=%s", e.Type, e.ID, e.Camera)
+
+	h.lock.Lock()
+	for c := range h.m {
+		// skip clients that are not keeping up rather than block the publisher
+		select {
+		case c <- e:
+		default:
+		}
+	}
+	h.lock.Unlock()
+	return e
+}
+
+// webhookClient posts events to webhooks without hanging on slow receivers.
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// postWebhook POSTs e as JSON to url.
+func postWebhook(url string, e event) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("unable to marshal event: %v", err)
+		return
+	}
+
+	resp, err := webhookClient.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		log.Printf("webhook %s: %v", url, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("webhook %s: %s", url, resp.Status)
+	}
+}
+
+// ServeHTTP streams events to the client as server-sent events.
+func (h *eventHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	c := make(chan event, 16)
+	h.lock.Lock()
+	h.m[c] = true
+	h.lock.Unlock()
+
+	defer func() {
+		h.lock.Lock()
+		delete(h.m, c)
+		h.lock.Unlock()
+	}()
+
+	for {
+		select {
+		case e := <-c:
+			data, err := json.Marshal(e)
+			if err != nil {
+				log.Printf("unable to marshal event: %v", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\nid: %s\ndata: %s\n\n", e.Type, e.ID, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"encoding/json"
+	"image"
+	"image/color"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+func init() {
+	RegisterProcessor("gesture", newGestureStage)
+}
+
+// The gestures a student can answer a confirmation with.
+const (
+	gestureConfirm = "confirm"
+	gestureReject  = "reject"
+)
+
+// The states of a confirmation, reported in "confirm" events.
+const (
+	confirmAsking    = "asking"
+	confirmConfirmed = "confirmed"
+	confirmRejected  = "rejected"
+	confirmExpired   = "expired"
+)
+
+// gestureWidth is the width frames are scaled to before looking for hands.
+const gestureWidth = 320
+
+// confirmEvent is the data of a "confirm" event, raised when the kiosk asks a
+// student to confirm who they are and again when they answer or the time is
+// up.
+type confirmEvent struct {
+	ID         string          `json:"id"`
+	State      string          `json:"state"`
+	Student    string          `json:"student"`
+	Confidence float64         `json:"confidence"`
+	Rect       image.Rectangle `json:"rect"`
+	// Prompt is what the kiosk asks, such as "Are you Maria? Show a
+	// thumbs-up".
+	Prompt  string    `json:"prompt,omitempty"`
+	Expires time.Time `json:"expires"`
+}
+
+// pendingCheckin is a check-in waiting for the student to confirm it.
+type pendingCheckin struct {
+	id      string
+	res     faceResult
+	auto    bool
+	expires time.Time
+}
+
+// confirmations holds a camera's pending check-in. There is only ever one: a
+// new one replaces the last, since the kiosk asks whoever is in front of it.
+type confirmations struct {
+	lock    sync.Mutex
+	pending *pendingCheckin
+}
+
+// confirmPrompt asks the student recognized as student to confirm it.
+func confirmPrompt(student string) string {
+	name := student
+	if f := strings.Fields(student); len(f) > 0 {
+		name = f[0]
+	}
+	return "Are you " + name + "? Show a thumbs-up"
+}
+
+// askToConfirm holds the check-in of res until the student confirms it with
+// a gesture, and raises a "confirm" event asking them to.
+func (c *camera) askToConfirm(res faceResult, auto bool) {
+	p := &pendingCheckin{id: newEventID(), res: res, auto: auto, expires: time.Now().Add(c.cfg.Confirm.window())}
+
+	c.confirmations.lock.Lock()
+	old := c.confirmations.pending
+	c.confirmations.pending = p
+	c.confirmations.lock.Unlock()
+
+	if old != nil {
+		c.publishConfirm(old, confirmExpired)
+	}
+	c.publishConfirm(p, confirmAsking)
+
+	// expire it on time even if the camera stops sending frames
+	time.AfterFunc(c.cfg.Confirm.window(), func() { c.resolveConfirmation(p, confirmExpired) })
+}
+
+// pendingConfirmation returns the check-in waiting for confirmation, if any.
+func (c *camera) pendingConfirmation() *pendingCheckin {
+	c.confirmations.lock.Lock()
+	defer c.confirmations.lock.Unlock()
+	return c.confirmations.pending
+}
+
+// resolveConfirmation ends p with state, checking the student in if they
+// confirmed and forgetting who their track is if they rejected. It does
+// nothing if p was already replaced, and an answer that comes after p
+// expires, such as from a frame held up by a stalled camera, only expires it.
+func (c *camera) resolveConfirmation(p *pendingCheckin, state string) {
+	c.confirmations.lock.Lock()
+	if c.confirmations.pending != p {
+		c.confirmations.lock.Unlock()
+		return
+	}
+	c.confirmations.pending = nil
+	c.confirmations.lock.Unlock()
+
+	if time.Now().After(p.expires) {
+		state = confirmExpired
+	}
+
+	c.publishConfirm(p, state)
+	switch state {
+	case confirmConfirmed:
+		c.publishCheckin(p.res, p.auto, true)
+	case confirmRejected:
+		// let recognition have another go at the face
+		if c.tracker != nil {
+			c.tracker.identify(p.res.Rect, faceResult{Rect: p.res.Rect})
+		}
+	}
+}
+
+func (c *camera) publishConfirm(p *pendingCheckin, state string) {
+	data := confirmEvent{
+		ID:         p.id,
+		State:      state,
+		Student:    p.res.StudentName,
+		Confidence: p.res.Confidence,
+		Rect:       p.res.Rect,
+		Expires:    p.expires,
+	}
+	if state == confirmAsking {
+		data.Prompt = confirmPrompt(p.res.StudentName)
+	}
+	events.publish(event{Type: "confirm", Camera: c.id, Data: data})
+}
+
+// handReading is what the hand reader made of one frame.
+type handReading struct {
+	Gesture  string
+	Fingers  int
+	Solidity float64
+	Rect     image.Rectangle
+}
+
+// handReader finds the largest patch of skin in a frame that isn't a face
+// and tells a thumbs-up or single finger from an open palm by the convexity
+// defects between the fingers, like gocv's hand-gestures example.
+type handReader struct {
+	cfg    confirmConfig
+	kernel gocv.Mat
+}
+
+func newHandReader(cfg confirmConfig) *handReader {
+	return &handReader{cfg: cfg, kernel: gocv.GetStructuringElement(gocv.MorphEllipse, image.Pt(5, 5))}
+}
+
+// read looks for a hand gesture in img. faces are hidden first, since they
+// are skin too.
+func (h *handReader) read(img gocv.Mat, faces []image.Rectangle) handReading {
+	if img.Empty() {
+		return handReading{}
+	}
+
+	small := gocv.NewMat()
+	defer small.Close()
+	scale := 1.0
+	if img.Cols() > gestureWidth {
+		scale = float64(gestureWidth) / float64(img.Cols())
+		gocv.Resize(img, &small, image.Pt(gestureWidth, int(float64(img.Rows())*scale)), 0, 0, gocv.InterpolationArea)
+	} else {
+		img.CopyTo(small)
+	}
+
+	mask := gocv.NewMat()
+	defer mask.Close()
+	gocv.CvtColor(small, &small, gocv.ColorBGRToYCrCb)
+	lo, hi := h.cfg.skinLow(), h.cfg.skinHigh()
+	gocv.InRangeWithScalar(small, gocv.NewScalar(lo[0], lo[1], lo[2], 0), gocv.NewScalar(hi[0], hi[1], hi[2], 0), &mask)
+
+	// hide the faces and the necks below them
+	for _, f := range faces {
+		f = withMargin(f, 0.2)
+		f.Max.Y += f.Dy() / 2
+		gocv.Rectangle(&mask, scaleRect(f, scale), color.RGBA{0, 0, 0, 0}, -1)
+	}
+
+	gocv.MorphologyEx(mask, &mask, gocv.MorphOpen, h.kernel)
+	gocv.Dilate(mask, &mask, h.kernel)
+	gocv.GaussianBlur(mask, &mask, image.Pt(5, 5), 0, 0, gocv.BorderDefault)
+	gocv.Threshold(mask, &mask, 127, 255, gocv.ThresholdBinary)
+
+	var hand []image.Point
+	var area float64
+	for _, c := range gocv.FindContours(mask, gocv.RetrievalExternal, gocv.ChainApproxSimple) {
+		if a := gocv.ContourArea(c); a > area {
+			hand, area = c, a
+		}
+	}
+	if len(hand) < 5 || area < h.cfg.minArea()*float64(mask.Cols()*mask.Rows()) {
+		return handReading{}
+	}
+
+	reading := classifyHand(hand, area)
+	reading.Rect = scaleRect(gocv.BoundingRect(hand), 1/scale)
+	return reading
+}
+
+// classifyHand counts the fingers held up on the hand outlined by contour.
+// Every deep, narrow convexity defect is a gap between two fingers. With no
+// gaps, a thumb or finger sticking out of a fist leaves the hand much less
+// solid than its hull, where a bare fist nearly fills it.
+func classifyHand(contour []image.Point, area float64) handReading {
+	hull := gocv.NewMat()
+	defer hull.Close()
+	gocv.ConvexHull(contour, &hull, true, false)
+
+	var hullPoints []image.Point
+	for i := 0; i < hull.Rows(); i++ {
+		hullPoints = append(hullPoints, contour[hull.GetIntAt(i, 0)])
+	}
+	reading := handReading{Solidity: area / gocv.ContourArea(hullPoints)}
+
+	defects := gocv.NewMat()
+	defer defects.Close()
+	gocv.ConvexityDefects(contour, hull, &defects)
+
+	box := gocv.BoundingRect(contour)
+	minDepth := 0.15 * float64(box.Dy())
+	gaps := 0
+	for i := 0; i < defects.Rows(); i++ {
+		start := contour[defects.GetIntAt(i, 0)]
+		end := contour[defects.GetIntAt(i, 1)]
+		far := contour[defects.GetIntAt(i, 2)]
+		depth := float64(defects.GetIntAt(i, 3)) / 256
+
+		a := math.Hypot(float64(end.X-start.X), float64(end.Y-start.Y))
+		b := math.Hypot(float64(far.X-start.X), float64(far.Y-start.Y))
+		c := math.Hypot(float64(end.X-far.X), float64(end.Y-far.Y))
+		if b == 0 || c == 0 {
+			continue
+		}
+		// cosine rule for the angle between the fingers
+		angle := math.Acos((b*b+c*c-a*a)/(2*b*c)) * 180 / math.Pi
+		if angle <= 90 && depth >= minDepth {
+			gaps++
+		}
+	}
+
+	switch {
+	case gaps > 0:
+		reading.Fingers = gaps + 1
+	case reading.Solidity < 0.8:
+		reading.Fingers = 1
+	}
+	switch {
+	case reading.Fingers == 1:
+		reading.Gesture = gestureConfirm
+	case reading.Fingers >= 4:
+		reading.Gesture = gestureReject
+	}
+	return reading
+}
+
+func (h *handReader) Close() error {
+	return h.kernel.Close()
+}
+
+// gestureTally counts the frames in a row a gesture was seen in, so that a
+// gesture is only taken once it has been held and not on stray frames. A
+// frame with another gesture or none starts the count over.
+type gestureTally struct {
+	frames  int
+	gesture string
+	run     int
+}
+
+func newGestureTally(frames int) *gestureTally {
+	return &gestureTally{frames: frames}
+}
+
+// add counts a frame's gesture and returns it once it has been held for
+// enough frames in a row.
+func (t *gestureTally) add(gesture string) string {
+	if gesture == "" || gesture != t.gesture {
+		t.gesture, t.run = gesture, 0
+	}
+	if gesture == "" {
+		return ""
+	}
+	t.run++
+	if t.run >= t.frames {
+		return gesture
+	}
+	return ""
+}
+
+func (t *gestureTally) reset() {
+	t.gesture, t.run = "", 0
+}
+
+// gestureStage watches for the answer to a pending check-in: a thumbs-up or
+// one finger confirms it, an open palm rejects it, and nothing before it
+// expires drops it. It only looks for hands while a check-in is pending, and
+// should come after the detect and track stages so faces can be hidden. What
+// it made of each frame is in ctx.Values["gesture"] as a handReading.
+type gestureStage struct {
+	cam    *camera
+	reader *handReader
+	tally  *gestureTally
+	// watching is the check-in the tally is for.
+	watching *pendingCheckin
+}
+
+func newGestureStage(cam *camera, output string, params json.RawMessage) (Processor, error) {
+	var cfg confirmConfig
+	if err := json.Unmarshal(params, &cfg); err != nil {
+		return nil, err
+	}
+	return &gestureStage{cam: cam, reader: newHandReader(cfg), tally: newGestureTally(cfg.frames())}, nil
+}
+
+func (s *gestureStage) Process(ctx *FrameContext) error {
+	p := s.cam.pendingConfirmation()
+	if p != s.watching {
+		s.watching = p
+		s.tally.reset()
+	}
+	if p == nil {
+		return nil
+	}
+	if ctx.Time.After(p.expires) {
+		s.cam.resolveConfirmation(p, confirmExpired)
+		return nil
+	}
+
+	reading := s.reader.read(ctx.Image, ctx.Faces)
+	ctx.Values["gesture"] = reading
+	switch s.tally.add(reading.Gesture) {
+	case gestureConfirm:
+		s.cam.resolveConfirmation(p, confirmConfirmed)
+	case gestureReject:
+		s.cam.resolveConfirmation(p, confirmRejected)
+	}
+	return nil
+}
+
+func (s *gestureStage) Close() error {
+	return s.reader.Close()
+}
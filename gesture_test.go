@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"image"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+func TestGestureTally(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames int
+		seen   []string
+		want   []string
+	}{
+		{"held", 3, []string{gestureConfirm, gestureConfirm, gestureConfirm}, []string{"", "", gestureConfirm}},
+		{"held past", 2, []string{gestureReject, gestureReject, gestureReject}, []string{"", gestureReject, gestureReject}},
+		{"nothing", 1, []string{"", ""}, []string{"", ""}},
+		{"gaps reset", 3, []string{gestureConfirm, gestureConfirm, "", gestureConfirm, gestureConfirm}, []string{"", "", "", "", ""}},
+		{"held after a gap", 2, []string{gestureConfirm, "", gestureConfirm, gestureConfirm}, []string{"", "", "", gestureConfirm}},
+		{"alternating", 2, []string{gestureConfirm, gestureReject, gestureConfirm, gestureReject, gestureConfirm}, []string{"", "", "", "", ""}},
+		{"interrupted", 3, []string{gestureConfirm, gestureConfirm, gestureReject, gestureConfirm, gestureConfirm}, []string{"", "", "", "", ""}},
+		{"counted apart", 2, []string{gestureConfirm, gestureReject, gestureReject}, []string{"", "", gestureReject}},
+		{"reset forgets", 2, []string{gestureConfirm, "reset", gestureConfirm, gestureConfirm}, []string{"", "", "", gestureConfirm}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tally := newGestureTally(tt.frames)
+			for i, g := range tt.seen {
+				if g == "reset" {
+					tally.reset()
+					continue
+				}
+				if got := tally.add(g); got != tt.want[i] {
+					t.Errorf("add #%d (%q) = %q, want %q", i, g, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestConfirmPrompt(t *testing.T) {
+	tests := []struct {
+		student, want string
+	}{
+		{"Maria Lopez", "Are you Maria? Show a thumbs-up"},
+		{"Sam", "Are you Sam? Show a thumbs-up"},
+		{"  Ana  Maria ", "Are you Ana? Show a thumbs-up"},
+	}
+	for _, tt := range tests {
+		if got := confirmPrompt(tt.student); got != tt.want {
+			t.Errorf("confirmPrompt(%q) = %q, want %q", tt.student, got, tt.want)
+		}
+	}
+}
+
+// The hands drawn in the gesture fixtures by testdata/makeclips.go, before
+// they are scaled.
+var (
+	handThumbsUp = []image.Point{{2, 0}, {8, -6}, {16, -8}, {22, -4}, {24, 80}, {44, 84}, {62, 88}, {72, 92}, {76, 108}, {74, 126}, {64, 134}, {10, 134}, {2, 126}, {0, 108}, {2, 84}}
+	handOneUp    = []image.Point{{31, -13}, {38, -16}, {45, -13}, {47, 66}, {70, 76}, {74, 96}, {72, 114}, {62, 122}, {12, 122}, {4, 114}, {2, 96}, {6, 76}, {29, 66}}
+	handOpenPalm = []image.Point{{8, 130}, {2, 118}, {-28, 88}, {-36, 78}, {-32, 70}, {-24, 72}, {2, 90}, {4, 56}, {6, 16}, {13, 12}, {20, 16}, {24, 54}, {30, 54}, {32, 6}, {39, 2}, {46, 6}, {48, 54}, {54, 54}, {56, 10}, {63, 6}, {70, 10}, {72, 56}, {78, 56}, {80, 26}, {86, 22}, {92, 26}, {92, 70}, {88, 118}, {80, 130}}
+	handFist     = []image.Point{{10, 0}, {56, 0}, {66, 10}, {66, 48}, {56, 58}, {10, 58}, {0, 48}, {0, 10}}
+)
+
+func TestConfirmBounds(t *testing.T) {
+	cfg := confirmConfig{Below: 0.75}
+	tests := []struct {
+		conf           float64
+		needed, unsure bool
+	}{
+		{0.9, false, false},
+		{0.5, true, false},
+		{0.1, true, true},
+	}
+	for _, tt := range tests {
+		if got := cfg.needed(tt.conf); got != tt.needed {
+			t.Errorf("needed(%v) = %t, want %t", tt.conf, got, tt.needed)
+		}
+		if got := cfg.unsure(tt.conf); got != tt.unsure {
+			t.Errorf("unsure(%v) = %t, want %t", tt.conf, got, tt.unsure)
+		}
+	}
+	if (confirmConfig{}).unsure(0.1) {
+		t.Error("dropped an unsure match with confirmation off")
+	}
+}
+
+// TestConfirmExpiry leaves a confirmation unanswered with no frames coming
+// in, then answers one that has run out.
+func TestConfirmExpiry(t *testing.T) {
+	events = newEventHub()
+	got := make(chan event, 16)
+	events.m[got] = true
+	next := func() event {
+		select {
+		case e := <-got:
+			return e
+		case <-time.After(2 * time.Second):
+			t.Fatal("no event")
+		}
+		return event{}
+	}
+
+	cam := &camera{id: "lobby", cfg: cameraConfig{Confirm: confirmConfig{Below: 0.75, Window: 0.05}}}
+	res := faceResult{Matched: true, StudentName: "Maria Lopez", Confidence: 0.6}
+	cam.askToConfirm(res, true)
+	if e := next(); e.Data.(confirmEvent).State != confirmAsking {
+		t.Fatalf("got %+v, want the student asked", e)
+	}
+	if e := next(); e.Data.(confirmEvent).State != confirmExpired {
+		t.Fatalf("got %+v, want the confirmation expired", e)
+	}
+	if p := cam.pendingConfirmation(); p != nil {
+		t.Errorf("%s is still waiting after it expired", p.id)
+	}
+
+	// a frame held up until after the window can't confirm any more
+	p := &pendingCheckin{id: "late", res: res, expires: time.Now().Add(-time.Second)}
+	cam.confirmations.pending = p
+	cam.resolveConfirmation(p, confirmConfirmed)
+	if e := next(); e.Type != "confirm" || e.Data.(confirmEvent).State != confirmExpired {
+		t.Errorf("got %s %+v, want the late confirmation expired", e.Type, e.Data)
+	}
+	select {
+	case e := <-got:
+		t.Errorf("got %s %+v after the confirmation expired", e.Type, e.Data)
+	default:
+	}
+}
+
+func TestClassifyHand(t *testing.T) {
+	tests := []struct {
+		name    string
+		outline []image.Point
+		fingers int
+		gesture string
+	}{
+		{"thumbs-up", handThumbsUp, 1, gestureConfirm},
+		{"one finger", handOneUp, 1, gestureConfirm},
+		{"open palm", handOpenPalm, 5, gestureReject},
+		{"fist", handFist, 0, ""},
+	}
+	for _, tt := range tests {
+		for _, reversed := range []bool{false, true} {
+			contour := make([]image.Point, len(tt.outline))
+			for i, p := range tt.outline {
+				if reversed {
+					i = len(contour) - 1 - i
+				}
+				// as in the clips, and clear of the edge of a frame
+				contour[i] = image.Pt(100+p.X*6/5, 50+p.Y*6/5)
+			}
+			r := classifyHand(contour, gocv.ContourArea(contour))
+			if r.Fingers != tt.fingers || r.Gesture != tt.gesture {
+				t.Errorf("%s (reversed %t): fingers, gesture = %d, %q, want %d, %q (solidity %.2f)", tt.name, reversed, r.Fingers, r.Gesture, tt.fingers, tt.gesture, r.Solidity)
+			}
+		}
+	}
+}
+
+// TestGestureFixtures reads the clips in testdata/gestures with the default
+// confirm settings.
+func TestGestureFixtures(t *testing.T) {
+	path := filepath.Join("testdata", "gestures", "manifest.json")
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest gestureManifest
+	err = json.NewDecoder(f).Decode(&manifest)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	det, err := newFaceDetector(detectConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer det.Close()
+	var cfg confirmConfig
+	reader := newHandReader(cfg)
+	defer reader.Close()
+
+	for _, clip := range manifest.Clips {
+		t.Run(clip.File, func(t *testing.T) {
+			file := filepath.Join(filepath.Dir(path), clip.File)
+			if _, err := os.Stat(file); err != nil {
+				t.Skip(err)
+			}
+			got, after, err := evaluateGestureClip(file, det, reader, cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != clip.Gesture {
+				t.Errorf("got %s after %v, want %s", got, after, clip.Gesture)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+// gestureManifest lists recorded clips and the answer each one shows:
+// "confirm", "reject" or "none". Clip paths are relative to the manifest.
+type gestureManifest struct {
+	Clips []gestureClip `json:"clips"`
+}
+
+type gestureClip struct {
+	File    string `json:"file"`
+	Gesture string `json:"gesture"`
+	Note    string `json:"note"`
+}
+
+// evaluateGestures runs the gesture stage's hand reader over every clip in
+// the manifest at path, as if a confirmation was asked for as the clip
+// starts, and prints how it did. A confirmation taken from a clip that
+// doesn't show one would check in the wrong student, so those are counted
+// on their own.
+func evaluateGestures(path string, detect detectConfig, cfg confirmConfig) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	var manifest gestureManifest
+	err = json.NewDecoder(f).Decode(&manifest)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	det, err := newFaceDetector(detect)
+	if err != nil {
+		return err
+	}
+	defer det.Close()
+	reader := newHandReader(cfg)
+	defer reader.Close()
+
+	var n, right, falseConfirms, missing int
+	fmt.Println("clip\texpected\tgot\tafter")
+	for _, clip := range manifest.Clips {
+		expected := clip.Gesture
+		if expected == "" {
+			expected = "none"
+		}
+		file := filepath.Join(filepath.Dir(path), clip.File)
+		got, after, err := evaluateGestureClip(file, det, reader, cfg)
+		if err != nil {
+			fmt.Printf("%s\t%s\t-\t%v\n", clip.File, expected, err)
+			missing++
+			continue
+		}
+		n++
+		fmt.Printf("%s\t%s\t%s\t%.1fs\n", clip.File, expected, got, after.Seconds())
+
+		if got == expected {
+			right++
+		} else if got == gestureConfirm {
+			falseConfirms++
+		}
+	}
+
+	fmt.Printf("\n%d clips, %d right (%.1f%%), %d wrongly confirmed\n", n, right, percent(right, n), falseConfirms)
+	if missing > 0 {
+		fmt.Printf("%d clips missing or unreadable, left out\n", missing)
+	}
+	return nil
+}
+
+// evaluateGestureClip plays one clip through a hand reader until a gesture
+// has been held for long enough or the confirmation window is over. It
+// returns the gesture, or "none", and how far into the clip it was taken.
+func evaluateGestureClip(file string, det faceDetector, reader *handReader, cfg confirmConfig) (string, time.Duration, error) {
+	if _, err := os.Stat(file); err != nil {
+		return "", 0, err
+	}
+	video, err := gocv.VideoCaptureFile(file)
+	if err != nil {
+		return "", 0, fmt.Errorf("error opening video file: %v", file)
+	}
+	defer video.Close()
+
+	fps := video.Get(gocv.VideoCaptureFPS)
+	if fps <= 0 {
+		fps = 30
+	}
+
+	img := gocv.NewMat()
+	defer img.Close()
+
+	tally := newGestureTally(cfg.frames())
+	var at time.Duration
+	for n := 0; video.Read(&img) && !img.Empty(); n++ {
+		at = time.Duration(float64(n) / fps * float64(time.Second))
+		if at > cfg.window() {
+			break
+		}
+		if g := tally.add(reader.read(img, det.Detect(img)).Gesture); g != "" {
+			return g, at, nil
+		}
+	}
+	return "none", at, nil
+}
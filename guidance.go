@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"image"
+)
+
+func init() {
+	RegisterProcessor("guidance", newGuidanceStage)
+}
+
+// The prompts that tell a student how to get into position. Like the quality
+// reasons they are phrased for the student, and are also spoken as they are.
+const (
+	guideCloser = "step closer"
+	guideBack   = "step back"
+	guideLeft   = "move left"
+	guideRight  = "move right"
+	guideUp     = "look up"
+)
+
+// faceGuidance is where the face nearest the kiosk is in the frame and what
+// the student should do about it. Message is empty when nobody is there or
+// the face is in position. It is the data of a "guidance" event.
+type faceGuidance struct {
+	Message string          `json:"message"`
+	Present bool            `json:"present"`
+	Face    image.Rectangle `json:"face"`
+	// Size is the width of the face as a fraction of the frame's.
+	Size float64 `json:"size"`
+	// OffsetX and OffsetY are how far the centre of the face is from the
+	// middle of the frame, from -1 at the left or top edge to 1 at the right
+	// or bottom one.
+	OffsetX float64 `json:"offset_x"`
+	OffsetY float64 `json:"offset_y"`
+	// Outside lists the edges of the frame that cut the face off.
+	Outside []string `json:"outside,omitempty"`
+}
+
+// guidanceStage works out from the largest face where the student stands
+// relative to the camera, and raises a "guidance" event whenever the prompt
+// changes. Short students and wheelchair users often stand where their face
+// is too small or half out of the frame, and would otherwise get no answer.
+// The stable guidance is kept in ctx.Guidance for the overlay and the audio
+// endpoint.
+type guidanceStage struct {
+	cfg    guidanceConfig
+	mirror bool
+
+	current faceGuidance
+	pending faceGuidance
+	count   int // frames pending has held for
+}
+
+func newGuidanceStage(cam *camera, output string, params json.RawMessage) (Processor, error) {
+	var cfg guidanceConfig
+	if err := json.Unmarshal(params, &cfg); err != nil {
+		return nil, err
+	}
+	return &guidanceStage{cfg: cfg, mirror: cam.cfg.Transform.Mirror}, nil
+}
+
+func (s *guidanceStage) Process(ctx *FrameContext) error {
+	g := s.guide(ctx.Faces, image.Rect(0, 0, ctx.Image.Cols(), ctx.Image.Rows()))
+
+	// a prompt has to hold for a few frames, so that a face wobbling on a
+	// threshold doesn't make the prompt flicker
+	switch {
+	case sameGuidance(g, s.current):
+		s.current, s.count = g, 0
+	case s.count > 0 && sameGuidance(g, s.pending):
+		s.count++
+	default:
+		s.pending, s.count = g, 1
+	}
+	if s.count >= s.cfg.frames() {
+		s.current, s.count = g, 0
+		ctx.Emit(event{Type: "guidance", Data: g})
+	}
+
+	current := s.current
+	ctx.Guidance = &current
+	return nil
+}
+
+// guide works out the prompt for the largest of faces in a frame of bounds.
+func (s *guidanceStage) guide(faces []image.Rectangle, bounds image.Rectangle) faceGuidance {
+	var g faceGuidance
+	for _, f := range faces {
+		if f.Dx() > g.Face.Dx() {
+			g.Face = f
+		}
+	}
+	if g.Face.Empty() || bounds.Empty() {
+		return g
+	}
+	g.Present = true
+
+	w, h := float64(bounds.Dx()), float64(bounds.Dy())
+	g.Size = float64(g.Face.Dx()) / w
+	centre := g.Face.Min.Add(g.Face.Max).Div(2)
+	g.OffsetX = (float64(centre.X) - w/2) / (w / 2)
+	g.OffsetY = (float64(centre.Y) - h/2) / (h / 2)
+
+	edge := int(s.cfg.edge() * w)
+	if g.Face.Min.X <= bounds.Min.X+edge {
+		g.Outside = append(g.Outside, "left")
+	}
+	if g.Face.Max.X >= bounds.Max.X-edge {
+		g.Outside = append(g.Outside, "right")
+	}
+	if g.Face.Min.Y <= bounds.Min.Y+edge {
+		g.Outside = append(g.Outside, "top")
+	}
+	if g.Face.Max.Y >= bounds.Max.Y-edge {
+		g.Outside = append(g.Outside, "bottom")
+	}
+
+	// a face too close to fit matters most, then one cut off by the frame,
+	// then its size, then where it is; only one prompt is given at a time
+	switch {
+	case g.Size > s.cfg.maxSize():
+		g.Message = guideBack
+	case outside(g, "left"):
+		g.Message = s.sideways(-1)
+	case outside(g, "right"):
+		g.Message = s.sideways(1)
+	case outside(g, "bottom"):
+		g.Message = guideUp
+	case outside(g, "top"):
+		g.Message = guideBack
+	case g.Size < s.cfg.minSize():
+		g.Message = guideCloser
+	case g.OffsetX < -s.cfg.maxOffset():
+		g.Message = s.sideways(-1)
+	case g.OffsetX > s.cfg.maxOffset():
+		g.Message = s.sideways(1)
+	case g.OffsetY > s.cfg.maxOffset():
+		g.Message = guideUp
+	case g.OffsetY < -s.cfg.maxOffset():
+		g.Message = guideBack
+	}
+	return g
+}
+
+// sideways is the prompt for a face off to one side of the frame, -1 for the
+// left of the picture and 1 for the right. The camera looks at the student,
+// so their left is the right of the picture unless it is mirrored.
+func (s *guidanceStage) sideways(side int) string {
+	if s.mirror {
+		side = -side
+	}
+	if side < 0 {
+		return guideLeft
+	}
+	return guideRight
+}
+
+// sameGuidance reports whether a and b would show the student the same.
+func sameGuidance(a, b faceGuidance) bool {
+	return a.Message == b.Message && a.Present == b.Present
+}
+
+// outside reports whether the edge of the frame cuts off the face of g.
+func outside(g faceGuidance, edge string) bool {
+	for _, e := range g.Outside {
+		if e == edge {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *guidanceStage) Close() error {
+	return nil
+}
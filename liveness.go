@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+func init() {
+	RegisterProcessor("liveness", newLivenessStage)
+}
+
+// livenessSize is the size faces are scaled to before they are compared
+// from frame to frame.
+var livenessSize = image.Pt(128, 128)
+
+// blinkLength is the longest the eyes can stay shut for it to count as a
+// blink rather than the eyes being lost.
+const blinkLength = 500 * time.Millisecond
+
+// livenessMatchIoU is how much the largest face has to overlap the one
+// before it to be judged as the same face when the pipeline doesn't track.
+const livenessMatchIoU = 0.3
+
+// The reasons a face fails the liveness check.
+const (
+	reasonTooSoon   = "not enough frames yet"
+	reasonNoMotion  = "no natural movement"
+	reasonNoBlink   = "no blink seen"
+	reasonPrint     = "looks like a print"
+	reasonScreen    = "looks like a screen"
+	reasonLiveCheck = "liveness check failed"
+)
+
+// livenessResult is how sure the liveness check is that a face belongs to a
+// person in front of the kiosk. Motion, Blink and Texture are the parts of
+// the score, each from 0 to 1.
+type livenessResult struct {
+	Score   float64 `json:"score"`
+	Live    bool    `json:"live"`
+	Blocked bool    `json:"blocked,omitempty"`
+	Reason  string  `json:"reason,omitempty"`
+	Motion  float64 `json:"motion"`
+	Blink   float64 `json:"blink"`
+	Texture float64 `json:"texture"`
+}
+
+// livenessSample is what one frame showed of a face.
+type livenessSample struct {
+	at      time.Time
+	motion  float64
+	eyes    int
+	texture float64
+}
+
+// livenessSubject follows the liveness signals of one face over time. A
+// photo or screen moves as one rigid plane, never blinks, and has the flat
+// texture of paper or the fine grid of a display; a face shows small uneven
+// motion across its surface, blinks every few seconds and has skin texture.
+type livenessSubject struct {
+	cfg     livenessConfig
+	eyes    *gocv.CascadeClassifier
+	prev    gocv.Mat
+	rect    image.Rectangle
+	samples []livenessSample
+}
+
+func newLivenessSubject(cfg livenessConfig, eyes *gocv.CascadeClassifier) *livenessSubject {
+	return &livenessSubject{cfg: cfg, eyes: eyes, prev: gocv.NewMat()}
+}
+
+// update adds the face at r in img, seen at time at, and judges the face.
+func (l *livenessSubject) update(img gocv.Mat, r image.Rectangle, at time.Time) livenessResult {
+	region := img.Region(r)
+	gray := toGray(region, 0)
+	region.Close()
+	gocv.Resize(gray, &gray, livenessSize, 0, 0, gocv.InterpolationArea)
+
+	sample := livenessSample{at: at, texture: laplacianVariance(gray)}
+	if !l.prev.Empty() {
+		sample.motion = flowSpread(l.prev, gray)
+	}
+	upper := gray.Region(image.Rect(0, 0, livenessSize.X, livenessSize.Y/2))
+	sample.eyes = len(l.eyes.DetectMultiScaleWithParams(upper, 1.1, 3, 0, image.Pt(12, 12), image.Pt(0, 0)))
+	upper.Close()
+	l.prev.Close()
+	l.prev = gray
+	return l.add(sample)
+}
+
+// add adds a sample, drops those older than the window and judges the face.
+func (l *livenessSubject) add(sample livenessSample) livenessResult {
+	l.samples = append(l.samples, sample)
+	for len(l.samples) > 0 && sample.at.Sub(l.samples[0].at) > l.cfg.window() {
+		l.samples = l.samples[1:]
+	}
+	return l.judge()
+}
+
+// judge scores the samples in the window.
+func (l *livenessSubject) judge() livenessResult {
+	var res livenessResult
+	var motion, texture float64
+	for _, s := range l.samples[1:] {
+		motion += s.motion
+	}
+	for _, s := range l.samples {
+		texture += s.texture
+	}
+	n := float64(len(l.samples))
+	if n > 1 {
+		res.Motion = clampFloat(motion/(n-1)/l.cfg.motionRef(), 0, 1)
+	}
+
+	texture /= n
+	switch {
+	case texture < l.cfg.minTexture():
+		res.Texture = texture / l.cfg.minTexture()
+	case texture > l.cfg.maxTexture():
+		res.Texture = l.cfg.maxTexture() / texture
+	default:
+		res.Texture = 1
+	}
+
+	if l.blinked() {
+		res.Blink = 1
+	}
+	res.Score = 0.4*res.Motion + 0.4*res.Blink + 0.2*res.Texture
+	res.Live = res.Score >= l.cfg.threshold()
+
+	span := l.samples[len(l.samples)-1].at.Sub(l.samples[0].at)
+	switch {
+	case span < l.cfg.window()/2:
+		res.Live, res.Reason = false, reasonTooSoon
+	case res.Live:
+	case res.Texture < 1 && texture < l.cfg.minTexture():
+		res.Reason = reasonPrint
+	case res.Texture < 1:
+		res.Reason = reasonScreen
+	case res.Motion < 0.5:
+		res.Reason = reasonNoMotion
+	case res.Blink == 0:
+		res.Reason = reasonNoBlink
+	default:
+		res.Reason = reasonLiveCheck
+	}
+	return res
+}
+
+// blinked reports whether the window holds a blink: open eyes, then a short
+// run of frames with none, then open eyes again.
+func (l *livenessSubject) blinked() bool {
+	var closedSince time.Time
+	open, closed := false, false
+	for _, s := range l.samples {
+		switch {
+		case s.eyes > 0 && closed && s.at.Sub(closedSince) <= blinkLength:
+			return true
+		case s.eyes > 0:
+			open, closed = true, false
+		case open && !closed:
+			closed, closedSince = true, s.at
+		}
+	}
+	return false
+}
+
+func (l *livenessSubject) Close() error {
+	return l.prev.Close()
+}
+
+// flowSpread measures how unevenly a face moved between two frames: the
+// standard deviation of the dense optical flow's magnitude. A rigid photo
+// moves all of a piece and has almost none.
+func flowSpread(prev, next gocv.Mat) float64 {
+	flow := gocv.NewMat()
+	defer flow.Close()
+	gocv.CalcOpticalFlowFarneback(prev, next, &flow, 0.5, 3, 15, 3, 5, 1.2, 0)
+
+	xy := gocv.Split(flow)
+	defer func() {
+		for _, c := range xy {
+			c.Close()
+		}
+	}()
+	mag := gocv.NewMat()
+	defer mag.Close()
+	gocv.Magnitude(xy[0], xy[1], &mag)
+
+	_, stddev := meanStdDev(mag)
+	return stddev
+}
+
+// livenessStage judges every tracked face, or the largest face if the
+// pipeline doesn't track, and sets ctx.Liveness. Under the "block" policy
+// faces that fail are marked so they can't be checked in.
+type livenessStage struct {
+	cfg      livenessConfig
+	eyes     *gocv.CascadeClassifier
+	subjects map[string]*livenessSubject
+	lastSeen map[string]time.Time
+}
+
+func newLivenessStage(cam *camera, output string, params json.RawMessage) (Processor, error) {
+	var cfg livenessConfig
+	if err := json.Unmarshal(params, &cfg); err != nil {
+		return nil, err
+	}
+	switch cfg.policy() {
+	case "off", "warn", "block":
+	default:
+		return nil, fmt.Errorf("unknown policy %q", cfg.Policy)
+	}
+
+	s := &livenessStage{
+		cfg:      cfg,
+		subjects: make(map[string]*livenessSubject),
+		lastSeen: make(map[string]time.Time),
+	}
+	if cfg.policy() == "off" {
+		return s, nil
+	}
+	var err error
+	if s.eyes, err = loadEyeCascade(cfg.eyeCascade(), "liveness"); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// loadEyeCascade loads the eye cascade at path for the check named by what.
+// The check can't do without it, so a cascade that won't load is an error
+// rather than a check that quietly never runs.
+func loadEyeCascade(path, what string) (*gocv.CascadeClassifier, error) {
+	eyes := gocv.NewCascadeClassifier()
+	if !eyes.Load(path) {
+		eyes.Close()
+		return nil, fmt.Errorf("%s needs the eye cascade %s: haarcascade_eye.xml ships next to haarcascade_frontalface_default.xml (go generate fetches it again), or set eye_cascade", what, path)
+	}
+	return &eyes, nil
+}
+
+func (s *livenessStage) Process(ctx *FrameContext) error {
+	if s.cfg.policy() == "off" {
+		return nil
+	}
+
+	ctx.Liveness = make([]*livenessResult, len(ctx.Faces))
+	bounds := image.Rect(0, 0, ctx.Image.Cols(), ctx.Image.Rows())
+	largest := -1
+	for i, r := range ctx.Faces {
+		if largest < 0 || r.Dx() > ctx.Faces[largest].Dx() {
+			largest = i
+		}
+	}
+
+	for i, r := range ctx.Faces {
+		key := ""
+		if i < len(ctx.Tracks) {
+			key = ctx.Tracks[i].ID
+		} else if i != largest {
+			// without tracks only the largest face can be followed
+			continue
+		}
+		if r = r.Intersect(bounds); r.Empty() {
+			continue
+		}
+
+		res := s.subject(key, r, ctx.Time).update(ctx.Image, r, ctx.Time)
+		res.Blocked = !res.Live && s.cfg.policy() == "block"
+		ctx.Liveness[i] = &res
+	}
+
+	for key, at := range s.lastSeen {
+		if ctx.Time.Sub(at) > s.cfg.window() {
+			s.subjects[key].Close()
+			delete(s.subjects, key)
+			delete(s.lastSeen, key)
+		}
+	}
+	return nil
+}
+
+// subject returns the subject for the face at r with the given track key,
+// starting a new one if there is none. Without tracks every face has the
+// empty key, so when the largest face no longer overlaps the last one it is
+// someone else and starts afresh rather than inheriting their blinks and
+// movement.
+func (s *livenessStage) subject(key string, r image.Rectangle, at time.Time) *livenessSubject {
+	subject, ok := s.subjects[key]
+	if ok && key == "" && iou(subject.rect, r) < livenessMatchIoU {
+		subject.Close()
+		ok = false
+	}
+	if !ok {
+		subject = newLivenessSubject(s.cfg, s.eyes)
+		s.subjects[key] = subject
+	}
+	subject.rect = r
+	s.lastSeen[key] = at
+	return subject
+}
+
+func (s *livenessStage) Close() error {
+	for _, subject := range s.subjects {
+		subject.Close()
+	}
+	if s.eyes != nil {
+		return s.eyes.Close()
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"image"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// livenessSamples makes a window of samples, ten a second for seconds, all
+// with the same motion and texture and with eyes(i) eyes on the ith.
+func livenessSamples(seconds, motion, texture float64, eyes func(i int) int) []livenessSample {
+	start := time.Now()
+	var samples []livenessSample
+	for i := 0; i <= int(seconds*10); i++ {
+		samples = append(samples, livenessSample{
+			at:      start.Add(time.Duration(i) * 100 * time.Millisecond),
+			motion:  motion,
+			eyes:    eyes(i),
+			texture: texture,
+		})
+	}
+	return samples
+}
+
+func eyesOpen(i int) int { return 2 }
+
+// blinkAt closes the eyes for frames frames from the 10th.
+func blinkAt(frames int) func(i int) int {
+	return func(i int) int {
+		if i >= 10 && i < 10+frames {
+			return 0
+		}
+		return 2
+	}
+}
+
+func TestLivenessJudge(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     livenessConfig
+		samples []livenessSample
+		score   float64
+		live    bool
+		reason  string
+	}{
+		{
+			name:    "moving face that blinks",
+			samples: livenessSamples(3, 0.3, 100, blinkAt(2)),
+			score:   1, live: true,
+		},
+		{
+			name:    "moving face that doesn't blink",
+			samples: livenessSamples(3, 0.3, 100, eyesOpen),
+			score:   0.4 + 0.2, live: true,
+		},
+		{
+			name:    "moving face that doesn't blink under a higher threshold",
+			cfg:     livenessConfig{Threshold: 0.7},
+			samples: livenessSamples(3, 0.3, 100, eyesOpen),
+			score:   0.4 + 0.2, reason: reasonNoBlink,
+		},
+		{
+			name:    "eyes lost for too long to be a blink",
+			cfg:     livenessConfig{Threshold: 0.7},
+			samples: livenessSamples(3, 0.3, 100, blinkAt(8)),
+			score:   0.4 + 0.2, reason: reasonNoBlink,
+		},
+		{
+			name:    "barely moving face that blinks",
+			cfg:     livenessConfig{Threshold: 0.7},
+			samples: livenessSamples(3, 0.03, 100, blinkAt(2)),
+			score:   0.4*0.1 + 0.4 + 0.2, reason: reasonNoMotion,
+		},
+		{
+			name:    "still print",
+			samples: livenessSamples(3, 0, 10, eyesOpen),
+			score:   0.2 * 0.5, reason: reasonPrint,
+		},
+		{
+			name:    "still print that seems to blink",
+			samples: livenessSamples(3, 0, 5, blinkAt(2)),
+			score:   0.4 + 0.2*0.25, reason: reasonPrint,
+		},
+		{
+			name:    "screen",
+			samples: livenessSamples(3, 0, 3000, eyesOpen),
+			score:   0.2 * 0.5, reason: reasonScreen,
+		},
+		{
+			name:    "half the window",
+			samples: livenessSamples(1.5, 0.3, 100, blinkAt(2)),
+			score:   1, reason: reasonTooSoon,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &livenessSubject{cfg: tt.cfg, samples: tt.samples}
+			res := l.judge()
+			if d := res.Score - tt.score; d > 1e-9 || d < -1e-9 {
+				t.Errorf("score = %v, want %v (motion %v, blink %v, texture %v)", res.Score, tt.score, res.Motion, res.Blink, res.Texture)
+			}
+			if res.Live != tt.live || res.Reason != tt.reason {
+				t.Errorf("live, reason = %t, %q, want %t, %q", res.Live, res.Reason, tt.live, tt.reason)
+			}
+		})
+	}
+}
+
+// TestLivenessSubjectChange holds a photo up where a live student stood a
+// moment before, without tracking. The photo mustn't pass on the student's
+// blinks and movement.
+func TestLivenessSubjectChange(t *testing.T) {
+	s := &livenessStage{
+		subjects: make(map[string]*livenessSubject),
+		lastSeen: make(map[string]time.Time),
+	}
+	defer s.Close()
+
+	student := image.Rect(100, 100, 200, 200)
+	var res livenessResult
+	for i, sample := range livenessSamples(3, 0.3, 100, blinkAt(2)) {
+		// a little sway is still the same face
+		r := student.Add(image.Pt(i%3*5, 0))
+		res = s.subject("", r, sample.at).add(sample)
+	}
+	if !res.Live {
+		t.Fatalf("the student isn't live: %+v", res)
+	}
+	first := s.subjects[""]
+
+	photo := image.Rect(300, 120, 390, 210)
+	for i, sample := range livenessSamples(3, 0, 10, eyesOpen) {
+		sample.at = sample.at.Add(3100 * time.Millisecond)
+		res = s.subject("", photo, sample.at).add(sample)
+		if res.Live {
+			t.Fatalf("the photo is live %d frames after the student left: %+v", i, res)
+		}
+	}
+	if s.subjects[""] == first {
+		t.Error("the photo was judged as the student")
+	}
+	if res.Reason != reasonPrint {
+		t.Errorf("the photo failed with %q, want %q", res.Reason, reasonPrint)
+	}
+}
+
+// TestLivenessFixtures runs the check over the clips in testdata/liveness
+// with the default settings and the eye cascade that ships with the kiosk.
+func TestLivenessFixtures(t *testing.T) {
+	path := filepath.Join("testdata", "liveness", "manifest.json")
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest livenessManifest
+	err = json.NewDecoder(f).Decode(&manifest)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cfg livenessConfig
+	eyes, err := loadEyeCascade(cfg.eyeCascade(), "liveness")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer eyes.Close()
+	det, err := newFaceDetector(detectConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer det.Close()
+
+	for _, clip := range manifest.Clips {
+		t.Run(clip.File, func(t *testing.T) {
+			file := filepath.Join(filepath.Dir(path), clip.File)
+			if _, err := os.Stat(file); err != nil {
+				t.Skip(err)
+			}
+			accepted, best, reason, err := evaluateLivenessClip(file, det, cfg, eyes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if accepted != clip.Live {
+				t.Errorf("accepted = %t with best score %.2f and reason %q, want %t", accepted, best, reason, clip.Live)
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+// livenessManifest lists recorded clips and whether each shows a real
+// student or a spoof. Clip paths are relative to the manifest.
+type livenessManifest struct {
+	Clips []livenessClip `json:"clips"`
+}
+
+type livenessClip struct {
+	File string `json:"file"`
+	Live bool   `json:"live"`
+	Note string `json:"note"`
+}
+
+// evaluateLiveness runs the liveness check over every clip in the manifest
+// at path, following the largest face, and prints how it did. A clip is
+// accepted if the face is judged live at any point, since that is all a
+// spoof needs to get checked in.
+func evaluateLiveness(path string, detect detectConfig, cfg livenessConfig) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	var manifest livenessManifest
+	err = json.NewDecoder(f).Decode(&manifest)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	det, err := newFaceDetector(detect)
+	if err != nil {
+		return err
+	}
+	defer det.Close()
+	eyes, err := loadEyeCascade(cfg.eyeCascade(), "liveness")
+	if err != nil {
+		return err
+	}
+	defer eyes.Close()
+
+	var live, spoofs, rejectedLive, acceptedSpoofs, missing int
+	fmt.Println("clip\tlive\taccepted\tbest score\treason")
+	for _, clip := range manifest.Clips {
+		file := filepath.Join(filepath.Dir(path), clip.File)
+		accepted, best, reason, err := evaluateLivenessClip(file, det, cfg, eyes)
+		if err != nil {
+			// one clip that hasn't been recorded yet shouldn't hide how
+			// the others did
+			fmt.Printf("%s\t%t\t-\t-\t%v\n", clip.File, clip.Live, err)
+			missing++
+			continue
+		}
+		fmt.Printf("%s\t%t\t%t\t%.2f\t%s\n", clip.File, clip.Live, accepted, best, reason)
+
+		if clip.Live {
+			live++
+			if !accepted {
+				rejectedLive++
+			}
+		} else {
+			spoofs++
+			if accepted {
+				acceptedSpoofs++
+			}
+		}
+	}
+
+	fmt.Printf("\n%d live clips, %d rejected (BPCER %.1f%%)\n", live, rejectedLive, percent(rejectedLive, live))
+	fmt.Printf("%d spoof clips, %d accepted (APCER %.1f%%)\n", spoofs, acceptedSpoofs, percent(acceptedSpoofs, spoofs))
+	if missing > 0 {
+		fmt.Printf("%d clips missing or unreadable, left out\n", missing)
+	}
+	return nil
+}
+
+// evaluateLivenessClip plays one clip through a liveness subject. It returns
+// whether the face was ever judged live, its best score, and the reason it
+// gave on the last frame.
+func evaluateLivenessClip(file string, det faceDetector, cfg livenessConfig, eyes *gocv.CascadeClassifier) (bool, float64, string, error) {
+	if _, err := os.Stat(file); err != nil {
+		return false, 0, "", err
+	}
+	video, err := gocv.VideoCaptureFile(file)
+	if err != nil {
+		return false, 0, "", fmt.Errorf("error opening video file: %v", file)
+	}
+	defer video.Close()
+
+	fps := video.Get(gocv.VideoCaptureFPS)
+	if fps <= 0 {
+		fps = 30
+	}
+
+	subject := newLivenessSubject(cfg, eyes)
+	defer subject.Close()
+
+	img := gocv.NewMat()
+	defer img.Close()
+
+	var accepted bool
+	var best float64
+	reason := "no face found"
+	start := time.Now()
+	for n := 0; video.Read(&img) && !img.Empty(); n++ {
+		var face image.Rectangle
+		for _, r := range det.Detect(img) {
+			if r.Dx() > face.Dx() {
+				face = r
+			}
+		}
+		if face.Empty() {
+			continue
+		}
+
+		at := start.Add(time.Duration(float64(n) / fps * float64(time.Second)))
+		res := subject.update(img, face, at)
+		accepted = accepted || res.Live
+		if res.Score > best {
+			best = res.Score
+		}
+		reason = res.Reason
+	}
+	return accepted, best, reason, nil
+}
+
+func percent(n, of int) float64 {
+	if of == 0 {
+		return 0
+	}
+	return float64(n) * 100 / float64(of)
+}
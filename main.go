@@ -11,18 +11,20 @@ MB_KEY="<your personal machinebox.io key from when you registered on the site>"
 
 docker run -p 8080:8080 -e "MB_KEY=$MB_KEY" machinebox/facebox
 
-3.  In the first terminal window where you ran source env.sh -  run this file:  go run main.go
+3.  In the first terminal window where you ran source env.sh -  run the kiosk:  go run .
 
 */
 
 import (
-	"bytes"
 	"encoding/json"
+	"flag"
+	"image"
 	"image/color"
 	"io"
 	"log"
 	"net/http"
-	"strings"
+	"os"
+	"time"
 
 	"github.com/gorilla/mux"
 
@@ -31,129 +33,222 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/polly"
-	"github.com/hybridgroup/mjpeg"
-	"gocv.io/x/gocv"
 )
 
+//go:generate curl -fsSLo haarcascade_eye.xml https://raw.githubusercontent.com/opencv/opencv/3.4.1/data/haarcascades/haarcascade_eye.xml
+
 var (
 	blue          = color.RGBA{0, 0, 255, 0}
 	faceAlgorithm = "haarcascade_frontalface_default.xml"
-	stream        *mjpeg.Stream
+	eyeAlgorithm  = "haarcascade_eye.xml"
+	cameras       *cameraSet
+	events        *eventHub
 	fbox          *facebox.Client
+	recognizer    *faceRecognizer
 	c1            = make(chan bool)
+
+	configFile       = flag.String("config", "", "path to the kiosk JSON config file")
+	compareDetectors = flag.String("compare-detectors", "", "run the Haar and SSD face detectors over a recorded video, print how they compare and exit")
+	evalLiveness     = flag.String("eval-liveness", "", "run the liveness check over the clips in a fixture manifest, print how it did and exit")
+	evalGestures     = flag.String("eval-gestures", "", "run the confirmation gestures over the clips in a fixture manifest, print how they did and exit")
 )
 
 func main() {
 
-	//create mjpeg stream and to send to web page
-	// create the mjpeg stream
-	stream = mjpeg.NewStream()
+	flag.Parse()
+
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		log.Fatalln("can't load config:", err)
+	}
+
+	if *compareDetectors != "" {
+		if err := compareFaceDetectors(*compareDetectors, cfg.detectSettings()); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+	if *evalLiveness != "" {
+		if err := evaluateLiveness(*evalLiveness, cfg.detectSettings(), cfg.cameras()[0].Liveness); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+	if *evalGestures != "" {
+		if err := evaluateGestures(*evalGestures, cfg.detectSettings(), cfg.cameras()[0].Confirm); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
+	// each camera gets a supervisor whose capture goroutine is the only thing
+	// that touches the device, and an mjpeg stream to send to the web page
+	cameras, err = newCameraSet(cfg)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	events = newEventHub()
+
+	if cfg.Clips.Dir != "" {
+		if err := os.MkdirAll(cfg.Clips.Dir, 0755); err != nil {
+			log.Fatalln("can't create clip directory:", err)
+		}
+	}
 
 	router := mux.NewRouter()
 
 	fbox = facebox.New("http://localhost:8080")
+	recognizer = newFaceRecognizer(cfg.Recognition)
 
-	go kiosk()
+	cameras.start()
+
+	if cfg.Occupancy.Camera != "" {
+		cam, ok := cameras.byID[cfg.Occupancy.Camera]
+		if !ok {
+			log.Fatalln("occupancy: unknown camera", cfg.Occupancy.Camera)
+		}
+		counter := newOccupancyCounter(cam, cfg.Occupancy)
+		go counter.run()
+		router.HandleFunc("/occupancy", counter.serveCount)
+		router.HandleFunc("/occupancy/history", counter.serveHistory)
+	}
 
 	// start http server
-	router.Handle("/camera", stream)
+	router.HandleFunc("/camera", cameras.serveStream)
+	router.HandleFunc("/camera/{id}", cameras.serveStream)
+	router.HandleFunc("/camera/{id}/{output}", cameras.serveStream)
 	log.Println("camera routed")
 
+	router.HandleFunc("/health/camera", cameras.serveHealth)
+	router.HandleFunc("/health/camera/{id}", cameras.serveHealth)
+	router.HandleFunc("/camera/{id}/tamper/baseline", cameras.rebaseline).Methods("POST")
+	router.Handle("/events", events)
+	router.HandleFunc("/metrics/pipeline", cameras.servePipelineMetrics)
+	router.HandleFunc("/snapshot", snapshot)
 	router.HandleFunc("/face", face)
+	router.HandleFunc("/enroll", enroll).Methods("POST")
 	router.HandleFunc("/audio/student/{student}/counselor/{counselor}", audioGreeting)
-
-	log.Fatal(http.ListenAndServe("localhost:8090", router))
-
-}
-
-func kiosk() {
-
-	webcam, err := gocv.VideoCaptureDevice(0)
-	if err != nil {
-		log.Fatalln("can't find camera")
+	router.HandleFunc("/audio/guidance", audioGuidance)
+	router.HandleFunc("/audio/guidance/{id}", audioGuidance)
+
+	// clips show students' faces, so they are kept off the public router
+	if cfg.Clips.Dir != "" && cfg.Clips.Listen != "" {
+		staff := mux.NewRouter()
+		staff.PathPrefix("/clips/").Handler(http.StripPrefix("/clips/", http.FileServer(http.Dir(cfg.Clips.Dir))))
+		go func() {
+			log.Fatal(http.ListenAndServe(cfg.Clips.Listen, staff))
+		}()
 	}
 
-	// prepare image matrix
-	img := gocv.NewMat()
-	defer img.Close()
-
-	for {
-		if ok := webcam.Read(&img); !ok || img.Empty() {
-			log.Print("cannot read webcam")
-			continue
-		}
-
-		buf, err := gocv.IMEncode(".jpg", img)
-
-		if err != nil {
-			log.Printf("unable to encode matrix: %v", err)
-			continue
-		}
-
-		stream.UpdateJPEG(buf)
+	log.Fatal(http.ListenAndServe("localhost:8090", router))
 
-	}
 }
 
 type jsonface struct {
 	StudentName    string `json:studentname`
 	CounselorName  string `json:counselorname`
 	CounselorImage string `json:counselorimage`
+	Camera         string
+	// Reason tells the student why their face wasn't sent to facebox,
+	// such as "move closer" or "too dark".
+	Reason string
+	// Faces has the result for every face that was recognized.
+	Faces []faceResult
+}
+
+// recognitionRects returns the faces in frame worth sending to facebox: the
+// ones that passed the quality stage, else every detected face, else the
+// whole frame when the pipeline doesn't detect faces.
+func recognitionRects(frame Frame) []image.Rectangle {
+	ctx := frame.Context
+	if q := ctx.Quality; q != nil {
+		var rects []image.Rectangle
+		for _, fq := range q.Faces {
+			if fq.OK {
+				rects = append(rects, fq.Rect)
+			}
+		}
+		return rects
+	}
+	if ctx.Faces != nil {
+		return ctx.Faces
+	}
+	return []image.Rectangle{image.Rect(0, 0, frame.Mat.Cols(), frame.Mat.Rows())}
 }
 
 func face(w http.ResponseWriter, r *http.Request) {
 
-	webcam, err := gocv.VideoCaptureDevice(0)
-	if err != nil {
-		log.Fatalln("can't find camera")
+	cam, ok := cameras.lookup(r)
+	if !ok {
+		http.Error(w, "unknown camera", http.StatusNotFound)
+		return
 	}
 
-	// prepare image matrix
-	img := gocv.NewMat()
-	defer img.Close()
+	if !cam.cfg.Checkin.manual() {
+		http.Error(w, "manual check-in is turned off for this camera", http.StatusForbidden)
+		return
+	}
 
-	if ok := webcam.Read(&img); !ok || img.Empty() {
-		log.Print("cannot read webcam")
+	frame, err := cam.analyzed.Fresh(2 * time.Second)
+	if err != nil {
+		log.Printf("cannot get frame: %v", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
 		return
 	}
+	defer frame.Close()
+
+	// don't ask facebox about blurry, half or turned faces; tell the student
+	// what to fix instead
+	if q := frame.Context.Quality; q != nil {
+		if _, ok := q.best(); !ok {
+			writeFaceJSON(w, jsonface{CounselorImage: "none.jpg", CounselorName: "Nope", Camera: cam.id, Reason: q.Reason})
+			return
+		}
+	}
 
-	buf, err := gocv.IMEncode(".jpg", img)
 	if fbox == nil {
 		log.Fatal("no fbox :-(")
 	}
 
-	faces, err := fbox.Check(bytes.NewReader(buf))
-
-	if err != nil {
-		log.Printf("unable to recognize face: %v", err)
+	bounds := image.Rect(0, 0, frame.Mat.Cols(), frame.Mat.Rows())
+	results := recognizer.recognize(frame.Mat, frame.Context.faceCrops(recognitionRects(frame)), cam.identities())
+	for i := range results {
+		results[i].Liveness = frame.Context.livenessOf(results[i].Rect)
+		cam.dropUnsure(&results[i])
 	}
+	checkins := recognizer.checkins(results, bounds)
 
-	if len(faces) > 0 {
-		log.Printf("this photo is  %v ", faces[0].Name)
-
+	faceJSON := jsonface{StudentName: "Who are you?", CounselorImage: "none.jpg", CounselorName: "Nope", Camera: cam.id, Faces: results}
+	if len(checkins) > 0 {
+		first := results[checkins[0]]
+		faceJSON.StudentName, faceJSON.CounselorName, faceJSON.CounselorImage = first.StudentName, first.CounselorName, first.CounselorImage
+	} else {
+		for _, res := range results {
+			if res.Matched && !res.checkable() {
+				faceJSON.Reason = res.Liveness.Reason
+				break
+			}
+		}
 	}
 
-	faceName := ""
-	image := ""
-	counselorName := ""
-
-	if len(faces[0].Name) == 0 {
-		faceName = "Who are you?"
-		image = "none.jpg"
-		counselorName = "Nope"
-	} else {
-		faceName = faces[0].Name
-		if strings.ToLower(string(faceName[0])) < "k" {
-			image = "wink.jpg"
-			counselorName = "Wink"
-		} else {
-			image = "lizzie.jpg"
-			counselorName = "Lizzie"
+	// a camera holds one check-in waiting for confirmation and asking again
+	// replaces it, so only the first face that needs confirming is asked,
+	// and the prompt is for that student
+	asked := false
+	for _, i := range checkins {
+		if asked && cam.cfg.Confirm.needed(results[i].Confidence) {
+			continue
+		}
+		if !cam.checkIn(results[i], false) {
+			asked = true
+			faceJSON.Reason = confirmPrompt(results[i].StudentName)
 		}
 	}
 
-	faceJSON := jsonface{StudentName: faceName, CounselorImage: image, CounselorName: counselorName}
+	writeFaceJSON(w, faceJSON)
+}
 
+func writeFaceJSON(w http.ResponseWriter, faceJSON jsonface) {
 	log.Println("faceJSON has  ", faceJSON)
 	jData, err := json.Marshal(faceJSON)
 	if err != nil {
@@ -172,13 +267,48 @@ func audioGreeting(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	log.Println("Generating text-to-speech for input", vars)
 
+	speak(w, "welcome "+vars["student"]+"! your counselor, "+vars["counselor"]+", will be with you shortly!")
+}
+
+// audioGuidance speaks the camera's current guidance prompt, such as "step
+// closer", if the camera has spoken guidance turned on. There is nothing to
+// say while nobody is there or the student is in position.
+func audioGuidance(w http.ResponseWriter, r *http.Request) {
+
+	cam, ok := cameras.lookup(r)
+	if !ok {
+		http.Error(w, "unknown camera", http.StatusNotFound)
+		return
+	}
+	if !cam.cfg.Guidance.Speak {
+		http.Error(w, "spoken guidance is turned off for this camera", http.StatusForbidden)
+		return
+	}
+
+	frame, err := cam.analyzed.Fresh(2 * time.Second)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	g := frame.Context.Guidance
+	frame.Close()
+	if g == nil || g.Message == "" {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	speak(w, "please "+g.Message)
+}
+
+// speak streams textToSpeak as mp3 from Amazon Polly.
+func speak(w http.ResponseWriter, textToSpeak string) {
+
 	// Initialize a session that the SDK uses to load credentials from the shared credentials file. (~/.aws/credentials).
 	sess := session.Must(session.NewSessionWithOptions(session.Options{
 		SharedConfigState: session.SharedConfigEnable,
 	}))
 
 	pollyService := polly.New(sess)
-	textToSpeak := "welcome " + vars["student"] + "! your counselor, " + vars["counselor"] + ", will be with you shortly!"
 	input := &polly.SynthesizeSpeechInput{OutputFormat: aws.String("mp3"), Text: aws.String(textToSpeak), VoiceId: aws.String("Nicole")}
 
 	output, err := pollyService.SynthesizeSpeech(input)
@@ -187,6 +317,7 @@ func audioGreeting(w http.ResponseWriter, r *http.Request) {
 		log.Print(err.Error())
 		w.WriteHeader(500)
 		w.Write([]byte("Error synthesizing text " + http.StatusText(500)))
+		return
 	}
 
 	w.Header().Set("Access-Control-Allow-Origin", "*")
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"image"
+
+	"gocv.io/x/gocv"
+)
+
+// toGray returns a single channel copy of img, scaled down so it is at most
+// width pixels wide. A width of zero keeps the original size.
+func toGray(img gocv.Mat, width int) gocv.Mat {
+	gray := gocv.NewMat()
+	if img.Channels() == 1 {
+		img.CopyTo(gray)
+	} else {
+		gocv.CvtColor(img, &gray, gocv.ColorBGRToGray)
+	}
+	if width > 0 && gray.Cols() > width {
+		h := gray.Rows() * width / gray.Cols()
+		gocv.Resize(gray, &gray, image.Pt(width, h), 0, 0, gocv.InterpolationArea)
+	}
+	return gray
+}
+
+// meanStdDev returns the mean and standard deviation of a single channel
+// image, which serve as its brightness and contrast.
+func meanStdDev(gray gocv.Mat) (mean, stddev float64) {
+	m := gocv.NewMat()
+	defer m.Close()
+	s := gocv.NewMat()
+	defer s.Close()
+
+	gocv.MeanStdDev(gray, &m, &s)
+	return m.GetDoubleAt(0, 0), s.GetDoubleAt(0, 0)
+}
+
+// laplacianVariance measures the sharpness of a single channel image. Blurry
+// or defocused images have little high-frequency detail and a low variance.
+func laplacianVariance(gray gocv.Mat) float64 {
+	lap := gocv.NewMat()
+	defer lap.Close()
+
+	gocv.Laplacian(gray, &lap, int(gocv.MatTypeCV64F), 1, 1, 0, gocv.BorderDefault)
+	_, stddev := meanStdDev(lap)
+	return stddev * stddev
+}
@@ -0,0 +1,202 @@
+// Package mjpegclient reads the kiosk's MJPEG camera streams and measures how
+// far behind the camera a client is and how many frames it misses.
+//
+// Each part of a kiosk stream carries the capture time (X-Timestamp), the
+// stream's sequence number (X-Frame-Seq) and the camera ID (X-Camera-ID).
+// Latency is the time between capture and receipt, so it is only meaningful
+// when the kiosk and the client clocks agree, for example on the same host or
+// both synced with NTP.
+//
+//	c, err := mjpegclient.Dial("http://localhost:8090/camera/north")
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	defer c.Close()
+//	for {
+//		part, err := c.Next()
+//		if err != nil {
+//			log.Fatal(err)
+//		}
+//		log.Println(part.Seq, part.Latency(), c.Stats().DropRate)
+//	}
+package mjpegclient
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Part is one JPEG read from the stream.
+type Part struct {
+	JPEG     []byte
+	Camera   string
+	Seq      uint64 // zero for generated frames such as the offline placeholder
+	Captured time.Time
+	Received time.Time
+}
+
+// Latency is how long after capture the part was received.
+func (p *Part) Latency() time.Duration {
+	if p.Captured.IsZero() {
+		return 0
+	}
+	return p.Received.Sub(p.Captured)
+}
+
+// Stats summarises what a client has received so far.
+type Stats struct {
+	Frames  uint64 // parts with a sequence number
+	Dropped uint64 // sequence numbers skipped between received parts
+	// DropRate is Dropped as a fraction of the frames the camera produced
+	// while the client was connected.
+	DropRate    float64
+	LastSeq     uint64
+	LatencyMin  time.Duration
+	LatencyMax  time.Duration
+	LatencyAvg  time.Duration
+	LatencyLast time.Duration
+}
+
+// Client reads parts from an MJPEG stream.
+type Client struct {
+	body io.ReadCloser
+	mr   *multipart.Reader
+
+	lock       sync.Mutex
+	stats      Stats
+	timed      uint64 // parts counted in stats that had an X-Timestamp
+	latencySum time.Duration
+}
+
+// Dial connects to the stream at url.
+func Dial(url string) (*Client, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("mjpegclient: %s returned %s", url, resp.Status)
+	}
+
+	c, err := NewClient(resp.Body, resp.Header.Get("Content-Type"))
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewClient reads a stream from r, whose multipart boundary is given in
+// contentType.
+func NewClient(r io.ReadCloser, contentType string) (*Client, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, fmt.Errorf("mjpegclient: bad content type %q: %v", contentType, err)
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") || params["boundary"] == "" {
+		return nil, fmt.Errorf("mjpegclient: %q is not a multipart stream", contentType)
+	}
+	return &Client{body: r, mr: multipart.NewReader(r, params["boundary"])}, nil
+}
+
+// Next blocks until the next part arrives and updates the client's stats.
+func (c *Client) Next() (*Part, error) {
+	p, err := c.mr.NextPart()
+	if err != nil {
+		return nil, err
+	}
+	defer p.Close()
+
+	jpeg, err := ioutil.ReadAll(p)
+	if err != nil {
+		return nil, err
+	}
+
+	part := &Part{JPEG: jpeg, Camera: p.Header.Get("X-Camera-ID"), Received: time.Now()}
+	if ts := p.Header.Get("X-Timestamp"); ts != "" {
+		if part.Captured, err = parseTimestamp(ts); err != nil {
+			return nil, err
+		}
+	}
+	if seq := p.Header.Get("X-Frame-Seq"); seq != "" {
+		if part.Seq, err = strconv.ParseUint(seq, 10, 64); err != nil {
+			return nil, fmt.Errorf("mjpegclient: bad X-Frame-Seq %q", seq)
+		}
+	}
+
+	c.record(part)
+	return part, nil
+}
+
+func (c *Client) record(p *Part) {
+	if p.Seq == 0 {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	s := &c.stats
+	if s.LastSeq > 0 && p.Seq > s.LastSeq+1 {
+		s.Dropped += p.Seq - s.LastSeq - 1
+	}
+	if p.Seq > s.LastSeq {
+		s.LastSeq = p.Seq
+	}
+	s.Frames++
+	s.DropRate = float64(s.Dropped) / float64(s.Frames+s.Dropped)
+
+	if p.Captured.IsZero() {
+		return
+	}
+	l := p.Latency()
+	c.timed++
+	s.LatencyLast = l
+	if c.timed == 1 || l < s.LatencyMin {
+		s.LatencyMin = l
+	}
+	if l > s.LatencyMax {
+		s.LatencyMax = l
+	}
+	c.latencySum += l
+	s.LatencyAvg = c.latencySum / time.Duration(c.timed)
+}
+
+// Stats returns the client's stats so far.
+func (c *Client) Stats() Stats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.stats
+}
+
+// Close disconnects from the stream.
+func (c *Client) Close() error {
+	return c.body.Close()
+}
+
+// parseTimestamp parses an X-Timestamp of the form seconds.microseconds.
+func parseTimestamp(ts string) (time.Time, error) {
+	parts := strings.SplitN(ts, ".", 2)
+	sec, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, errors.New("mjpegclient: bad X-Timestamp " + ts)
+	}
+	var usec int64
+	if len(parts) == 2 {
+		frac := (parts[1] + "000000")[:6]
+		if usec, err = strconv.ParseInt(frac, 10, 64); err != nil {
+			return time.Time{}, errors.New("mjpegclient: bad X-Timestamp " + ts)
+		}
+	}
+	return time.Unix(sec, usec*1000), nil
+}
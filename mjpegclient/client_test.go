@@ -0,0 +1,172 @@
+package mjpegclient
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	tests := []struct {
+		ts      string
+		want    time.Time
+		wantErr bool
+	}{
+		{"1500000000.123456", time.Unix(1500000000, 123456000), false},
+		{"1500000000", time.Unix(1500000000, 0), false},
+		// a short fraction is still a fraction of a second
+		{"1500000000.5", time.Unix(1500000000, 500000000), false},
+		{"1500000000.000001", time.Unix(1500000000, 1000), false},
+		{"", time.Time{}, true},
+		{"now", time.Time{}, true},
+		{"1500000000.x", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseTimestamp(tt.ts)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseTimestamp(%q) error = %v, want error %t", tt.ts, err, tt.wantErr)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("parseTimestamp(%q) = %v, want %v", tt.ts, got, tt.want)
+		}
+	}
+}
+
+func TestNewClientContentType(t *testing.T) {
+	tests := []struct {
+		contentType string
+		ok          bool
+	}{
+		{"multipart/x-mixed-replace;boundary=MJPEGBOUNDARY", true},
+		{"multipart/x-mixed-replace; boundary=\"MJPEGBOUNDARY\"", true},
+		{"multipart/x-mixed-replace", false},
+		{"image/jpeg", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		_, err := NewClient(ioutil.NopCloser(strings.NewReader("")), tt.contentType)
+		if (err == nil) != tt.ok {
+			t.Errorf("NewClient(%q) error = %v, want ok %t", tt.contentType, err, tt.ok)
+		}
+	}
+}
+
+// streamPart is one part the test server writes, in the kiosk's format.
+type streamPart struct {
+	seq  uint64    // zero writes no X-Frame-Seq, like the offline placeholder
+	at   time.Time // zero writes no X-Timestamp
+	jpeg string
+}
+
+// serveStream serves parts the way the kiosk's mjpegStream does: each part
+// starts with a CRLF and the boundary, and the stream ends with the closing
+// boundary.
+func serveStream(parts []streamPart) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "multipart/x-mixed-replace;boundary=MJPEGBOUNDARY")
+		for _, p := range parts {
+			fmt.Fprintf(w, "\r\n--MJPEGBOUNDARY\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\n", len(p.jpeg))
+			if !p.at.IsZero() {
+				fmt.Fprintf(w, "X-Timestamp: %d.%06d\r\n", p.at.Unix(), p.at.Nanosecond()/1000)
+			}
+			if p.seq != 0 {
+				fmt.Fprintf(w, "X-Frame-Seq: %d\r\n", p.seq)
+			}
+			fmt.Fprintf(w, "X-Camera-ID: north\r\n\r\n%s", p.jpeg)
+		}
+		io.WriteString(w, "\r\n--MJPEGBOUNDARY--\r\n")
+	}))
+}
+
+func TestClient(t *testing.T) {
+	captured := time.Now().Add(-time.Second).Truncate(time.Microsecond)
+	parts := []streamPart{
+		{1, captured, "one"},
+		{2, captured, "two"},
+		// 3 and 4 are dropped
+		{5, captured, "five"},
+		{0, captured, "placeholder"},
+		// a late part doesn't count as a drop or move LastSeq back
+		{4, captured, "four"},
+		{6, captured, "six"},
+		// counts as a frame but not towards the latency average
+		{7, time.Time{}, "untimed"},
+	}
+	srv := serveStream(parts)
+	defer srv.Close()
+
+	c, err := Dial(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for _, want := range parts {
+		p, err := c.Next()
+		if err != nil {
+			t.Fatalf("part %q: %v", want.jpeg, err)
+		}
+		if string(p.JPEG) != want.jpeg || p.Seq != want.seq || p.Camera != "north" {
+			t.Errorf("got part %q seq %d camera %q, want %q seq %d camera north", p.JPEG, p.Seq, p.Camera, want.jpeg, want.seq)
+		}
+		if !p.Captured.Equal(want.at) {
+			t.Errorf("part %q captured at %v, want %v", want.jpeg, p.Captured, want.at)
+		}
+		if want.at.IsZero() {
+			if p.Latency() != 0 {
+				t.Errorf("part %q without a timestamp has latency %v, want 0", want.jpeg, p.Latency())
+			}
+		} else if p.Latency() < time.Second {
+			t.Errorf("part %q latency %v, want at least 1s", want.jpeg, p.Latency())
+		}
+	}
+	if _, err := c.Next(); err != io.EOF {
+		t.Errorf("after the closing boundary Next returned %v, want io.EOF", err)
+	}
+
+	s := c.Stats()
+	if s.Frames != 6 || s.Dropped != 2 || s.LastSeq != 7 {
+		t.Errorf("got %d frames, %d dropped, last seq %d; want 6, 2, 7", s.Frames, s.Dropped, s.LastSeq)
+	}
+	if want := 2.0 / 8; s.DropRate != want {
+		t.Errorf("drop rate %v, want %v", s.DropRate, want)
+	}
+	if s.LatencyMin < time.Second || s.LatencyMin > s.LatencyAvg || s.LatencyAvg > s.LatencyMax {
+		t.Errorf("latency min %v avg %v max %v out of order or under 1s", s.LatencyMin, s.LatencyAvg, s.LatencyMax)
+	}
+}
+
+func TestDialStatus(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	if _, err := Dial(srv.URL); err == nil {
+		t.Error("Dial succeeded on a 404")
+	}
+}
+
+func TestClientBadHeaders(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+	}{
+		{"timestamp", "X-Timestamp: yesterday\r\n"},
+		{"sequence", "X-Frame-Seq: -1\r\n"},
+	}
+	for _, tt := range tests {
+		body := "\r\n--B\r\nContent-Type: image/jpeg\r\n" + tt.header + "\r\njpeg\r\n--B--\r\n"
+		c, err := NewClient(ioutil.NopCloser(strings.NewReader(body)), "multipart/x-mixed-replace;boundary=B")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Next(); err == nil {
+			t.Errorf("%s: Next accepted a bad %s", tt.name, tt.name)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+func init() {
+	RegisterProcessor("motion", newMotionStage)
+}
+
+// motionState is whether a camera is seeing anything move.
+type motionState string
+
+const (
+	motionActive motionState = "active"
+	motionIdle   motionState = "idle"
+)
+
+// motionEvent is the data of a "motion" event, raised when a camera goes
+// idle or wakes up.
+type motionEvent struct {
+	State motionState `json:"state"`
+	Ratio float64     `json:"ratio"`
+}
+
+// backgroundSubtractor is implemented by gocv's MOG2 and KNN subtractors.
+type backgroundSubtractor interface {
+	Apply(src gocv.Mat, dst *gocv.Mat)
+	Close() error
+}
+
+// motionStage gates the rest of the pipeline on motion. Every frame is
+// checked against a background model at low resolution, which is cheap. Once
+// the foreground has stayed under the threshold for a while the camera goes
+// idle and only a trickle of frames gets through to detection and encoding.
+// The first frame with motion wakes it up again.
+//
+// It sets the "motion" value to the frame's foreground ratio.
+type motionStage struct {
+	cfg      motionConfig
+	sub      backgroundSubtractor
+	fgMask   gocv.Mat
+	state    motionState
+	lastSeen time.Time
+	lastPass time.Time
+}
+
+func newMotionStage(cam *camera, output string, params json.RawMessage) (Processor, error) {
+	var cfg motionConfig
+	if err := json.Unmarshal(params, &cfg); err != nil {
+		return nil, err
+	}
+
+	s := &motionStage{cfg: cfg, fgMask: gocv.NewMat(), state: motionActive, lastSeen: time.Now()}
+	switch cfg.Algorithm {
+	case "", "mog2":
+		sub := gocv.NewBackgroundSubtractorMOG2()
+		s.sub = &sub
+	case "knn":
+		sub := gocv.NewBackgroundSubtractorKNN()
+		s.sub = &sub
+	default:
+		s.fgMask.Close()
+		return nil, fmt.Errorf("unknown algorithm %q", cfg.Algorithm)
+	}
+	return s, nil
+}
+
+func (s *motionStage) Process(ctx *FrameContext) error {
+	ratio := s.foreground(ctx.Original)
+	ctx.Values["motion"] = ratio
+
+	now := ctx.Time
+	if ratio >= s.cfg.threshold() {
+		s.lastSeen = now
+		if s.state == motionIdle {
+			s.transition(ctx, motionActive, ratio)
+		}
+	} else if s.state == motionActive && now.Sub(s.lastSeen) >= s.cfg.idleAfter() {
+		s.transition(ctx, motionIdle, ratio)
+	}
+
+	if s.state == motionIdle && now.Sub(s.lastPass) < s.cfg.idleInterval() {
+		return errSkipFrame
+	}
+	s.lastPass = now
+	return nil
+}
+
+// foreground updates the background model with img and returns the fraction
+// of it that is moving. Shadows, which MOG2 and KNN mark as gray, don't count.
+func (s *motionStage) foreground(img gocv.Mat) float64 {
+	small := gocv.NewMat()
+	defer small.Close()
+	img.CopyTo(small)
+	fitWithin(&small, s.cfg.width(), 0)
+
+	s.sub.Apply(small, &s.fgMask)
+	gocv.Threshold(s.fgMask, &s.fgMask, 200, 255, gocv.ThresholdBinary)
+
+	total := s.fgMask.Rows() * s.fgMask.Cols()
+	if total == 0 {
+		return 0
+	}
+	return float64(gocv.CountNonZero(s.fgMask)) / float64(total)
+}
+
+func (s *motionStage) transition(ctx *FrameContext, state motionState, ratio float64) {
+	log.Printf("motion %s: %s -> %s", ctx.Camera, s.state, state)
+	s.state = state
+	ctx.Emit(event{Type: "motion", Data: motionEvent{State: state, Ratio: ratio}})
+}
+
+func (s *motionStage) Close() error {
+	s.fgMask.Close()
+	return s.sub.Close()
+}
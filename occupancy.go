@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"image"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+// occupancy is the live count served at /occupancy.
+type occupancy struct {
+	Camera  string    `json:"camera"`
+	Count   int       `json:"count"`
+	Visible int       `json:"visible"`
+	Entries int       `json:"entries"`
+	Exits   int       `json:"exits"`
+	Since   time.Time `json:"since"`
+	Crowd   int       `json:"crowd,omitempty"`
+	Crowded bool      `json:"crowded"`
+}
+
+// occupancyHour is one hour of history served at /occupancy/history.
+type occupancyHour struct {
+	Hour    time.Time `json:"hour"`
+	Entries int       `json:"entries"`
+	Exits   int       `json:"exits"`
+	Peak    int       `json:"peak"`
+}
+
+// crowdEvent is the data of a "crowd" event.
+type crowdEvent struct {
+	State string `json:"state"` // "crowded" or "clear"
+	Count int    `json:"count"`
+	Crowd int    `json:"crowd"`
+}
+
+// person is someone followed by the centroid tracker.
+type person struct {
+	centroid image.Point
+	side     int // which side of the line they are on, 0 if on it
+	lastSeen time.Time
+}
+
+// occupancyCounter counts the students in the lobby, like gocv's counter
+// example. It detects people with the HOG people detector, follows them by
+// matching each detection to the nearest centroid seen before, and counts an
+// entry or exit whenever one crosses the line.
+type occupancyCounter struct {
+	camera string
+	cfg    occupancyConfig
+	frames *frameBroker
+
+	hog    gocv.HOGDescriptor
+	people []*person
+
+	lock    sync.Mutex
+	current occupancy
+	history []occupancyHour
+}
+
+func newOccupancyCounter(cam *camera, cfg occupancyConfig) *occupancyCounter {
+	hog := gocv.NewHOGDescriptor()
+	detector := gocv.HOGDefaultPeopleDetector()
+	hog.SetSVMDetector(detector)
+	detector.Close()
+
+	return &occupancyCounter{
+		camera:  cam.id,
+		cfg:     cfg,
+		frames:  cam.frames,
+		hog:     hog,
+		current: occupancy{Camera: cam.id, Since: time.Now(), Crowd: cfg.Crowd},
+	}
+}
+
+// run counts on a frame every interval.
+func (o *occupancyCounter) run() {
+
+	for {
+		time.Sleep(o.cfg.interval())
+
+		frame, err := o.frames.Latest(time.Second)
+		if err != nil {
+			continue
+		}
+		fitWithin(&frame.Mat, o.cfg.width(), 0)
+		size := image.Pt(frame.Mat.Cols(), frame.Mat.Rows())
+		rects := o.hog.DetectMultiScaleWithParams(frame.Mat, o.cfg.HitThreshold, image.Pt(8, 8), image.Pt(8, 8), 1.05, 2, false)
+		frame.Close()
+
+		o.update(rects, size, time.Now())
+	}
+}
+
+// update follows the people detected in a frame of the given size and
+// counts those who crossed the line.
+func (o *occupancyCounter) update(rects []image.Rectangle, size image.Point, now time.Time) {
+	line, inside := o.cfg.line()
+	from := scalePoint(line.From, size)
+	to := scalePoint(line.To, size)
+	in := sideOf(from, to, scalePoint(inside, size))
+	maxDist := o.cfg.maxDistance() * float64(size.X)
+
+	var entries, exits int
+	matched := make([]bool, len(o.people))
+	for _, r := range rects {
+		// people are counted where they stand, not by their middle
+		c := image.Pt((r.Min.X+r.Max.X)/2, r.Max.Y)
+		side := 0
+		if onSegment(from, to, c) {
+			side = sideOf(from, to, c)
+		}
+
+		best, bestDist := -1, maxDist
+		for i, p := range o.people {
+			if d := pointDistance(p.centroid, c); !matched[i] && d <= bestDist {
+				best, bestDist = i, d
+			}
+		}
+		if best < 0 {
+			o.people = append(o.people, &person{centroid: c, side: side, lastSeen: now})
+			matched = append(matched, true)
+			continue
+		}
+
+		p := o.people[best]
+		matched[best] = true
+		if p.side != 0 && side != 0 && side != p.side {
+			if side == in {
+				entries++
+			} else {
+				exits++
+			}
+		}
+		if side != 0 {
+			p.side = side
+		}
+		p.centroid, p.lastSeen = c, now
+	}
+
+	live := o.people[:0]
+	for _, p := range o.people {
+		if now.Sub(p.lastSeen) < o.cfg.lostAfter() {
+			live = append(live, p)
+		}
+	}
+	o.people = live
+
+	o.count(len(rects), entries, exits, now)
+}
+
+// count records the entries and exits of one frame.
+func (o *occupancyCounter) count(visible, entries, exits int, now time.Time) {
+	o.lock.Lock()
+	cur := &o.current
+	cur.Visible = visible
+	cur.Entries += entries
+	cur.Exits += exits
+	cur.Count += entries - exits
+	if cur.Count < 0 {
+		// someone was missed on the way in
+		cur.Count = 0
+	}
+
+	hour := now.Truncate(time.Hour)
+	if len(o.history) == 0 || !o.history[len(o.history)-1].Hour.Equal(hour) {
+		o.history = append(o.history, occupancyHour{Hour: hour})
+		if len(o.history) > o.cfg.historyHours() {
+			o.history = o.history[1:]
+		}
+	}
+	h := &o.history[len(o.history)-1]
+	h.Entries += entries
+	h.Exits += exits
+	if cur.Count > h.Peak {
+		h.Peak = cur.Count
+	}
+
+	crowded := o.cfg.Crowd > 0 && cur.Count >= o.cfg.Crowd
+	changed := crowded != cur.Crowded
+	cur.Crowded = crowded
+	count := cur.Count
+	o.lock.Unlock()
+
+	if entries+exits > 0 {
+		log.Printf("occupancy %s: %d in, %d out, %d in the lobby", o.camera, entries, exits, count)
+	}
+	if changed {
+		state := "clear"
+		if crowded {
+			state = "crowded"
+		}
+		events.publish(event{Type: "crowd", Camera: o.camera, Data: crowdEvent{State: state, Count: count, Crowd: o.cfg.Crowd}})
+	}
+}
+
+// serveCount serves the live occupancy.
+func (o *occupancyCounter) serveCount(w http.ResponseWriter, r *http.Request) {
+	o.lock.Lock()
+	cur := o.current
+	o.lock.Unlock()
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cur)
+}
+
+// serveHistory serves the hourly history, oldest first.
+func (o *occupancyCounter) serveHistory(w http.ResponseWriter, r *http.Request) {
+	o.lock.Lock()
+	history := append([]occupancyHour{}, o.history...)
+	o.lock.Unlock()
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
+}
+
+func scalePoint(p pointConfig, size image.Point) image.Point {
+	return image.Pt(int(p.X*float64(size.X)), int(p.Y*float64(size.Y)))
+}
+
+// sideOf returns 1 or -1 for the side of the line from a to b that p is on,
+// or 0 if it is on the line.
+func sideOf(a, b, p image.Point) int {
+	cross := (b.X-a.X)*(p.Y-a.Y) - (b.Y-a.Y)*(p.X-a.X)
+	switch {
+	case cross > 0:
+		return 1
+	case cross < 0:
+		return -1
+	}
+	return 0
+}
+
+// onSegment reports whether p is beside the segment from a to b rather than
+// beyond either end.
+func onSegment(a, b, p image.Point) bool {
+	d := b.Sub(a)
+	length := d.X*d.X + d.Y*d.Y
+	if length == 0 {
+		return false
+	}
+	t := float64((p.X-a.X)*d.X+(p.Y-a.Y)*d.Y) / float64(length)
+	return t >= 0 && t <= 1
+}
+
+func pointDistance(a, b image.Point) float64 {
+	return math.Hypot(float64(a.X-b.X), float64(a.Y-b.Y))
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"image"
+	"testing"
+	"time"
+)
+
+func TestSideOf(t *testing.T) {
+	a, b := image.Pt(0, 50), image.Pt(100, 50)
+	tests := []struct {
+		p    image.Point
+		want int
+	}{
+		{image.Pt(50, 80), 1},
+		{image.Pt(50, 20), -1},
+		{image.Pt(50, 50), 0},
+		// beyond the ends of the segment still has a side
+		{image.Pt(150, 80), 1},
+		{image.Pt(-50, 20), -1},
+	}
+	for _, tt := range tests {
+		if got := sideOf(a, b, tt.p); got != tt.want {
+			t.Errorf("sideOf(%v, %v, %v) = %d, want %d", a, b, tt.p, got, tt.want)
+		}
+		// the other way along the line the sides swap
+		if got := sideOf(b, a, tt.p); got != -tt.want {
+			t.Errorf("sideOf(%v, %v, %v) = %d, want %d", b, a, tt.p, got, -tt.want)
+		}
+	}
+}
+
+func TestOnSegment(t *testing.T) {
+	a, b := image.Pt(20, 50), image.Pt(80, 50)
+	tests := []struct {
+		p    image.Point
+		want bool
+	}{
+		{image.Pt(50, 10), true},
+		{image.Pt(20, 90), true},
+		{image.Pt(80, 50), true},
+		{image.Pt(10, 50), false},
+		{image.Pt(90, 10), false},
+	}
+	for _, tt := range tests {
+		if got := onSegment(a, b, tt.p); got != tt.want {
+			t.Errorf("onSegment(%v, %v, %v) = %t, want %t", a, b, tt.p, got, tt.want)
+		}
+	}
+	if onSegment(a, a, a) {
+		t.Error("a segment with no length has nothing beside it")
+	}
+}
+
+// TestOccupancyCrossing walks one person through frames of 100 by 100
+// pixels with the line across the middle, from x 20 to 80, and the lobby
+// above it.
+func TestOccupancyCrossing(t *testing.T) {
+	tests := []struct {
+		name           string
+		walk           []image.Point // where their feet are on each frame
+		entries, exits int
+		count          int
+	}{
+		{"walks in", []image.Point{{50, 80}, {50, 60}, {50, 40}, {50, 20}}, 1, 0, 1},
+		{"walks out", []image.Point{{50, 20}, {50, 40}, {50, 60}, {50, 80}}, 0, 1, 0},
+		{"stops on the line", []image.Point{{50, 80}, {50, 50}, {50, 50}}, 0, 0, 0},
+		{"steps over the line from on it", []image.Point{{50, 80}, {50, 50}, {50, 40}}, 1, 0, 1},
+		{"turns back on the line", []image.Point{{50, 80}, {50, 50}, {50, 60}}, 0, 0, 0},
+		{"walks in and out again", []image.Point{{50, 80}, {50, 60}, {50, 40}, {50, 60}, {50, 80}}, 1, 1, 0},
+		{"walks along the line", []image.Point{{30, 60}, {50, 60}, {70, 60}}, 0, 0, 0},
+		{"goes round the end of the line", []image.Point{{85, 80}, {90, 60}, {90, 40}, {85, 20}}, 0, 0, 0},
+		{"jumps too far to be followed", []image.Point{{50, 95}, {50, 5}}, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := &occupancyCounter{cfg: occupancyConfig{
+				MaxDistance: 0.3,
+				Line:        &lineConfig{From: pointConfig{0.2, 0.5}, To: pointConfig{0.8, 0.5}},
+				Inside:      &pointConfig{0.5, 0},
+			}}
+			now := time.Now()
+			for _, feet := range tt.walk {
+				o.update([]image.Rectangle{image.Rect(feet.X-5, feet.Y-30, feet.X+5, feet.Y)}, image.Pt(100, 100), now)
+				now = now.Add(o.cfg.interval())
+			}
+			cur := o.current
+			if cur.Entries != tt.entries || cur.Exits != tt.exits || cur.Count != tt.count {
+				t.Errorf("entries, exits, count = %d, %d, %d, want %d, %d, %d", cur.Entries, cur.Exits, cur.Count, tt.entries, tt.exits, tt.count)
+			}
+		})
+	}
+}
+
+func TestOccupancyConfigValidate(t *testing.T) {
+	across := &lineConfig{From: pointConfig{0, 0.6}, To: pointConfig{1, 0.6}}
+	tests := []struct {
+		name string
+		cfg  occupancyConfig
+		ok   bool
+	}{
+		{"default line", occupancyConfig{}, true},
+		{"line and inside", occupancyConfig{Line: across, Inside: &pointConfig{0.5, 0}}, true},
+		{"line without inside", occupancyConfig{Line: across}, false},
+		{"inside on the line", occupancyConfig{Line: across, Inside: &pointConfig{0.3, 0.6}}, false},
+		{"inside too close to the line", occupancyConfig{Line: across, Inside: &pointConfig{0.3, 0.605}}, false},
+		{"inside on the line beyond its end", occupancyConfig{Line: across, Inside: &pointConfig{2, 0.6}}, false},
+		{"line with no length", occupancyConfig{Line: &lineConfig{From: pointConfig{0.5, 0.5}, To: pointConfig{0.5, 0.5}}, Inside: &pointConfig{0, 0}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.validate()
+			if (err == nil) != tt.ok {
+				t.Errorf("validate() = %v, want ok %t", err, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+// FrameContext carries one frame through a camera's pipeline.
+//
+// Shared stages run first, on a working copy of the captured frame in Image.
+// Each output branch then gets its own context, a shallow copy of the shared
+// one whose Image is a fresh copy of Original, so a branch can draw on or
+// transform its picture without affecting the others or what was analysed.
+type FrameContext struct {
+	Camera string
+	Seq    uint64
+	Time   time.Time
+
+	// Original is the frame as captured. Stages must not modify it.
+	Original gocv.Mat
+	// Image is the picture the stage works on and may change in place.
+	Image gocv.Mat
+	// Output is the name of the output branch being rendered, or "" while
+	// the shared stages run.
+	Output string
+
+	// Faces are the faces found by the detect stage, in pixels of Original.
+	// Detected is false on frames the detect stage skipped, where a track
+	// stage fills Faces from the tracks it follows.
+	Faces    []image.Rectangle
+	Detected bool
+	// Tracks are the tracks of Faces, in the same order, if the pipeline
+	// has a track stage.
+	Tracks []faceTrack
+	// Approach is what the approach stage made of each of Faces, in the
+	// same order, or nil if the pipeline has no approach stage.
+	Approach []approachState
+	// Liveness is how sure the liveness stage is that each of Faces is a
+	// real person, in the same order. Faces it didn't judge are nil.
+	Liveness []*livenessResult
+	// Alignments are where the align stage found the eyes of each of Faces,
+	// in the same order.
+	Alignments []*faceAlignment
+	// Guidance is what the student in front should do to get into position,
+	// or nil if the pipeline has no guidance stage.
+	Guidance *faceGuidance
+	// Quality is how fit the faces are for recognition, or nil if the
+	// pipeline has no quality stage.
+	Quality *frameQuality
+
+	// Values holds results that stages pass on to later stages, keyed by a
+	// name the producing stage documents. Branches see the shared stages'
+	// values.
+	Values map[string]interface{}
+}
+
+// faceIndex returns the index in Faces of the face at r, or -1. Stages may
+// have clipped r to the frame, so a face that nearly covers it will do.
+func (ctx *FrameContext) faceIndex(r image.Rectangle) int {
+	for i, f := range ctx.Faces {
+		if f == r {
+			return i
+		}
+	}
+	for i, f := range ctx.Faces {
+		if iou(f, r) >= 0.8 {
+			return i
+		}
+	}
+	return -1
+}
+
+// livenessOf returns the liveness of the face at r, if it was judged.
+func (ctx *FrameContext) livenessOf(r image.Rectangle) *livenessResult {
+	if i := ctx.faceIndex(r); i >= 0 && i < len(ctx.Liveness) {
+		return ctx.Liveness[i]
+	}
+	return nil
+}
+
+// Emit publishes an event from the frame's camera.
+func (ctx *FrameContext) Emit(e event) event {
+	e.Camera = ctx.Camera
+	return events.publish(e)
+}
+
+// Processor is one stage of a camera pipeline. Stages run one frame at a
+// time on the camera's pipeline goroutine, in the order they are configured,
+// so they need no locking for their own state.
+//
+// Process can annotate ctx.Image, transform it, record results in
+// ctx.Values, or emit events. Returning errSkipFrame stops the frame at this
+// stage: later stages and outputs never see it. Any other error is logged and
+// counted, and the frame carries on.
+//
+// A site can add its own stage by putting a file in this package that calls
+// RegisterProcessor from an init function, then naming the stage's type in
+// the camera's pipeline config.
+type Processor interface {
+	Process(ctx *FrameContext) error
+	Close() error
+}
+
+// ProcessorFactory builds a stage from its config object, which holds the
+// stage's "type" and "name" plus any settings of its own. output is the
+// branch the stage is built for, or "" for a shared stage.
+type ProcessorFactory func(cam *camera, output string, params json.RawMessage) (Processor, error)
+
+// errSkipFrame is returned by a stage to drop the current frame.
+var errSkipFrame = errors.New("skip frame")
+
+var processors = make(map[string]ProcessorFactory)
+
+// RegisterProcessor makes a stage type available to pipeline configs.
+func RegisterProcessor(typ string, factory ProcessorFactory) {
+	if _, dup := processors[typ]; dup {
+		panic("pipeline: processor " + typ + " registered twice")
+	}
+	processors[typ] = factory
+}
+
+// stage is a configured processor and its timings.
+type stage struct {
+	name string
+	proc Processor
+	stat *stageTimer
+}
+
+// pipelineOutput is one rendered output of a camera, served as a stream and
+// kept in a broker for stills.
+type pipelineOutput struct {
+	name   string
+	stages []stage
+	stream *mjpegStream
+	frames *frameBroker
+	// privacy is how the output hides faces, set by its privacy stage.
+	privacy string
+}
+
+// pipeline takes a camera's captured frames through its shared stages, hands
+// the result to recognition, then renders each output branch.
+type pipeline struct {
+	cam     *camera
+	shared  []stage
+	outputs []*pipelineOutput
+	stats   []*stageTimer
+}
+
+// newPipeline builds the pipeline described by cfg. The camera's outputs
+// must already exist.
+func newPipeline(cam *camera, cfg pipelineConfig) (*pipeline, error) {
+	p := &pipeline{cam: cam}
+
+	var err error
+	if p.shared, err = p.build("", cfg.Stages); err != nil {
+		return nil, err
+	}
+	for _, out := range cam.outputList() {
+		if out.stages, err = p.build(out.name, cfg.Outputs[out.name]); err != nil {
+			return nil, err
+		}
+		p.outputs = append(p.outputs, out)
+	}
+	return p, nil
+}
+
+func (p *pipeline) build(output string, cfgs []stageConfig) ([]stage, error) {
+	var stages []stage
+	for _, sc := range cfgs {
+		factory, ok := processors[sc.Type]
+		if !ok {
+			return nil, fmt.Errorf("camera %s: unknown pipeline stage %q", p.cam.id, sc.Type)
+		}
+		proc, err := factory(p.cam, output, sc.raw)
+		if err != nil {
+			return nil, fmt.Errorf("camera %s: stage %s: %v", p.cam.id, sc.label(), err)
+		}
+
+		name := sc.label()
+		if output != "" {
+			name = output + "/" + name
+		}
+		st := &stageTimer{stats: stageStats{Stage: name}}
+		p.stats = append(p.stats, st)
+		stages = append(stages, stage{name: name, proc: proc, stat: st})
+	}
+	return stages, nil
+}
+
+// run processes every new frame from the camera, or streams a placeholder
+// while the camera is down.
+func (p *pipeline) run() {
+
+	var seq uint64
+	for {
+		frame, err := p.cam.frames.Next(seq, time.Second)
+		if err != nil {
+			if state := p.cam.super.State(); state != stateStreaming {
+				p.offline(state)
+			}
+			continue
+		}
+		seq = frame.Seq
+
+		p.process(frame)
+		frame.Close()
+	}
+}
+
+// process runs one frame through the shared stages and every output.
+func (p *pipeline) process(frame Frame) {
+	ctx := &FrameContext{
+		Camera:   p.cam.id,
+		Seq:      frame.Seq,
+		Time:     frame.Time,
+		Original: frame.Mat,
+		Image:    frame.Mat.Clone(),
+		Values:   make(map[string]interface{}),
+	}
+	defer ctx.Image.Close()
+
+	if !runStages(p.shared, ctx) {
+		return
+	}
+
+	// recognition reads the analysed frame and what the stages found in it
+	result := *ctx
+	result.Original, result.Image = gocv.Mat{}, gocv.Mat{}
+	p.cam.analyzed.publishFrame(ctx.Image, ctx.Seq, ctx.Time, &result)
+
+	for _, out := range p.outputs {
+		branch := *ctx
+		branch.Output = out.name
+		branch.Image = frame.Mat.Clone()
+		// branches may add values of their own without racing recognition
+		branch.Values = make(map[string]interface{}, len(ctx.Values))
+		for k, v := range ctx.Values {
+			branch.Values[k] = v
+		}
+		if runStages(out.stages, &branch) {
+			out.frames.publishFrame(branch.Image, branch.Seq, branch.Time, &result)
+		}
+		branch.Image.Close()
+	}
+}
+
+// runStages runs stages in order, reporting false if one dropped the frame.
+func runStages(stages []stage, ctx *FrameContext) bool {
+	for _, s := range stages {
+		start := time.Now()
+		err := s.proc.Process(ctx)
+		s.stat.record(time.Since(start), err)
+
+		if err == errSkipFrame {
+			return false
+		}
+		if err != nil {
+			log.Printf("camera %s: stage %s: %v", ctx.Camera, s.name, err)
+		}
+	}
+	return true
+}
+
+// offline streams the camera offline placeholder on every output.
+func (p *pipeline) offline(state cameraState) {
+	now := time.Now()
+	img := offlineFrame(state, now)
+	defer img.Close()
+
+	buf, err := gocv.IMEncode(".jpg", img)
+	if err != nil {
+		log.Printf("camera %s: unable to encode matrix: %v", p.cam.id, err)
+		return
+	}
+	for _, out := range p.outputs {
+		out.stream.UpdateJPEG(buf, false, now)
+	}
+}
+
+// Close releases every stage.
+func (p *pipeline) Close() error {
+	for _, s := range p.shared {
+		s.proc.Close()
+	}
+	for _, out := range p.outputs {
+		for _, s := range out.stages {
+			s.proc.Close()
+		}
+	}
+	return nil
+}
+
+// stageStats are the timings of one stage, served at /metrics/pipeline.
+type stageStats struct {
+	Stage   string  `json:"stage"`
+	Frames  uint64  `json:"frames"`
+	Skipped uint64  `json:"skipped"`
+	Errors  uint64  `json:"errors"`
+	LastMs  float64 `json:"last_ms"`
+	AvgMs   float64 `json:"avg_ms"`
+	MaxMs   float64 `json:"max_ms"`
+	totalMs float64
+}
+
+// stageTimer collects a stage's stats while the metrics endpoint reads them.
+type stageTimer struct {
+	lock  sync.Mutex
+	stats stageStats
+}
+
+func (t *stageTimer) record(d time.Duration, err error) {
+	ms := float64(d) / float64(time.Millisecond)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	s := &t.stats
+	s.Frames++
+	switch {
+	case err == errSkipFrame:
+		s.Skipped++
+	case err != nil:
+		s.Errors++
+	}
+	s.LastMs = ms
+	s.totalMs += ms
+	s.AvgMs = s.totalMs / float64(s.Frames)
+	if ms > s.MaxMs {
+		s.MaxMs = ms
+	}
+}
+
+func (t *stageTimer) snapshot() stageStats {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.stats
+}
+
+// servePipelineMetrics serves the stage timings of every camera.
+func (s *cameraSet) servePipelineMetrics(w http.ResponseWriter, r *http.Request) {
+	metrics := make(map[string][]stageStats)
+	for _, cam := range s.order {
+		var stats []stageStats
+		for _, st := range cam.pipeline.stats {
+			stats = append(stats, st.snapshot())
+		}
+		metrics[cam.id] = stats
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(metrics)
+}
+
+// outputList returns the camera's outputs in name order, with "raw" first.
+func (c *camera) outputList() []*pipelineOutput {
+	var list []*pipelineOutput
+	for _, out := range c.outputs {
+		list = append(list, out)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].name == "raw" || list[j].name == "raw" {
+			return list[i].name == "raw"
+		}
+		return list[i].name < list[j].name
+	})
+	return list
+}
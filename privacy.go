@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"sync"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+func init() {
+	RegisterProcessor("privacy", newPrivacyStage)
+}
+
+// privacyStage hides every face on an output branch by blurring or
+// pixelating it, like gocv's faceblur example. It works on the faces found
+// by the shared stages, so recognition never sees the hidden picture.
+type privacyStage struct {
+	cam *camera
+	cfg privacyConfig
+}
+
+func newPrivacyStage(cam *camera, output string, params json.RawMessage) (Processor, error) {
+	if output == "" {
+		return nil, errors.New("privacy only works in an output branch")
+	}
+	var cfg privacyConfig
+	if err := json.Unmarshal(params, &cfg); err != nil {
+		return nil, err
+	}
+	switch cfg.method() {
+	case "blur", "pixelate":
+	default:
+		return nil, fmt.Errorf("unknown method %q", cfg.Method)
+	}
+
+	cam.outputs[output].privacy = cfg.method()
+	return &privacyStage{cam: cam, cfg: cfg}, nil
+}
+
+func (s *privacyStage) Process(ctx *FrameContext) error {
+	bounds := image.Rect(0, 0, ctx.Image.Cols(), ctx.Image.Rows())
+	for i, r := range ctx.Faces {
+		if s.cfg.KeepCheckingIn && s.checkingIn(ctx, i) {
+			continue
+		}
+		r = withMargin(r, s.cfg.margin()).Intersect(bounds)
+		if r.Empty() {
+			continue
+		}
+
+		region := ctx.Image.Region(r)
+		if s.cfg.method() == "pixelate" {
+			pixelate(&region, s.cfg.blocks())
+		} else {
+			// a kernel a third of the face wide leaves nothing recognizable
+			k := r.Dx()/3 | 1
+			gocv.GaussianBlur(region, &region, image.Pt(k, k), 0, 0, gocv.BorderDefault)
+		}
+		region.Close()
+	}
+	return nil
+}
+
+// checkingIn reports whether face i of the frame is the student who was
+// last checked in, within the time their face stays clear.
+func (s *privacyStage) checkingIn(ctx *FrameContext, i int) bool {
+	last, ok := s.cam.lastCheckin()
+	if !ok || ctx.Time.Sub(last.at) > s.cfg.keepFor() {
+		return false
+	}
+	if last.track != "" && i < len(ctx.Tracks) {
+		return ctx.Tracks[i].ID == last.track
+	}
+	return iou(ctx.Faces[i], last.rect) >= 0.5
+}
+
+// pixelate replaces img, in place, with blocks by blocks squares of its
+// average colour.
+func pixelate(img *gocv.Mat, blocks int) {
+	size := image.Pt(img.Cols(), img.Rows())
+	small := gocv.NewMat()
+	defer small.Close()
+	gocv.Resize(*img, &small, image.Pt(blocks, blocks), 0, 0, gocv.InterpolationArea)
+	gocv.Resize(small, img, size, 0, 0, gocv.InterpolationNearestNeighbor)
+}
+
+func (s *privacyStage) Close() error {
+	return nil
+}
+
+// checkinRecord is where and when the camera last checked a student in.
+type checkinRecord struct {
+	rect  image.Rectangle
+	track string
+	at    time.Time
+}
+
+// checkinLog keeps a camera's last check-in for the privacy stage.
+type checkinLog struct {
+	lock sync.Mutex
+	last *checkinRecord
+}
+
+// recordCheckin remembers the face of a student just checked in.
+func (c *camera) recordCheckin(r image.Rectangle) {
+	rec := &checkinRecord{rect: r, at: time.Now()}
+	if c.tracker != nil {
+		c.tracker.lock.Lock()
+		if t := c.tracker.trackAt(r); t != nil {
+			rec.track = t.id
+		}
+		c.tracker.lock.Unlock()
+	}
+
+	c.checkins.lock.Lock()
+	c.checkins.last = rec
+	c.checkins.lock.Unlock()
+}
+
+// lastCheckin returns the camera's last check-in, if there was one.
+func (c *camera) lastCheckin() (checkinRecord, bool) {
+	c.checkins.lock.Lock()
+	defer c.checkins.lock.Unlock()
+	if c.checkins.last == nil {
+		return checkinRecord{}, false
+	}
+	return *c.checkins.last, true
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"image"
+
+	"gocv.io/x/gocv"
+)
+
+func init() {
+	RegisterProcessor("quality", newQualityStage)
+}
+
+// The reasons a face is turned away from recognition. They are phrased for
+// the student, so the UI can show them as they are.
+const (
+	reasonNoFace      = "step in front of the camera"
+	reasonTooSmall    = "move closer"
+	reasonTooDark     = "too dark"
+	reasonTooBright   = "too bright"
+	reasonLowContrast = "face the light"
+	reasonBlurry      = "hold still"
+	reasonNotFrontal  = "look at the camera"
+)
+
+// qualitySize is the size faces are scaled to before they are measured, so
+// that sharpness can be compared between near and far faces.
+var qualitySize = image.Pt(128, 128)
+
+// faceQuality is the measured quality of one detected face.
+type faceQuality struct {
+	Rect       image.Rectangle `json:"rect"`
+	Size       int             `json:"size"`
+	Sharpness  float64         `json:"sharpness"`
+	Brightness float64         `json:"brightness"`
+	Contrast   float64         `json:"contrast"`
+	Eyes       int             `json:"eyes"`
+	OK         bool            `json:"ok"`
+	Reason     string          `json:"reason,omitempty"`
+}
+
+// frameQuality is the quality of every face in a frame. Best is the index of
+// the largest face that passed, or -1, in which case Reason says why the
+// most promising face failed.
+type frameQuality struct {
+	Faces  []faceQuality `json:"faces"`
+	Best   int           `json:"best"`
+	Reason string        `json:"reason,omitempty"`
+}
+
+// best returns the face to recognize, if any passed.
+func (q *frameQuality) best() (faceQuality, bool) {
+	if q.Best < 0 {
+		return faceQuality{}, false
+	}
+	return q.Faces[q.Best], true
+}
+
+// qualityStage scores the faces found by the detect stage and sets
+// ctx.Quality, so recognition only gets faces that are big, sharp, well lit
+// and looking at the camera.
+type qualityStage struct {
+	cfg  qualityConfig
+	eyes *gocv.CascadeClassifier
+}
+
+func newQualityStage(cam *camera, output string, params json.RawMessage) (Processor, error) {
+	var cfg qualityConfig
+	if err := json.Unmarshal(params, &cfg); err != nil {
+		return nil, err
+	}
+
+	s := &qualityStage{cfg: cfg}
+	if cfg.minEyes() == 0 {
+		return s, nil
+	}
+	var err error
+	if s.eyes, err = loadEyeCascade(cfg.eyeCascade(), "min_eyes"); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *qualityStage) Process(ctx *FrameContext) error {
+	q := &frameQuality{Best: -1, Reason: reasonNoFace}
+	bounds := image.Rect(0, 0, ctx.Image.Cols(), ctx.Image.Rows())
+
+	bestSize, failedSize := 0, 0
+	for _, r := range ctx.Faces {
+		fq := s.measure(ctx.Image, r.Intersect(bounds))
+		q.Faces = append(q.Faces, fq)
+
+		switch {
+		case fq.OK && fq.Size > bestSize:
+			q.Best, bestSize = len(q.Faces)-1, fq.Size
+			q.Reason = ""
+		case !fq.OK && q.Best < 0 && fq.Size > failedSize:
+			// tell the student in front why they weren't recognized
+			q.Reason, failedSize = fq.Reason, fq.Size
+		}
+	}
+	ctx.Quality = q
+	return nil
+}
+
+// measure scores the face at r in img.
+func (s *qualityStage) measure(img gocv.Mat, r image.Rectangle) faceQuality {
+	fq := faceQuality{Rect: r, Size: r.Dx()}
+	if r.Empty() {
+		fq.Reason = reasonNoFace
+		return fq
+	}
+
+	region := img.Region(r)
+	gray := toGray(region, 0)
+	region.Close()
+	defer gray.Close()
+	gocv.Resize(gray, &gray, qualitySize, 0, 0, gocv.InterpolationArea)
+
+	fq.Brightness, fq.Contrast = meanStdDev(gray)
+	fq.Sharpness = laplacianVariance(gray)
+
+	switch {
+	case fq.Size < s.cfg.minSize():
+		fq.Reason = reasonTooSmall
+	case fq.Brightness < s.cfg.minBrightness():
+		fq.Reason = reasonTooDark
+	case fq.Brightness > s.cfg.maxBrightness():
+		fq.Reason = reasonTooBright
+	case fq.Contrast < s.cfg.minContrast():
+		fq.Reason = reasonLowContrast
+	case fq.Sharpness < s.cfg.minSharpness():
+		fq.Reason = reasonBlurry
+	}
+	if fq.Reason != "" {
+		return fq
+	}
+
+	if s.eyes != nil {
+		// eyes sit in the upper half of a frontal face
+		upper := gray.Region(image.Rect(0, 0, qualitySize.X, qualitySize.Y/2))
+		fq.Eyes = len(s.eyes.DetectMultiScaleWithParams(upper, 1.1, 3, 0, image.Pt(12, 12), image.Pt(0, 0)))
+		upper.Close()
+		if fq.Eyes < s.cfg.minEyes() {
+			fq.Reason = reasonNotFrontal
+			return fq
+		}
+	}
+	fq.OK = true
+	return fq
+}
+
+func (s *qualityStage) Close() error {
+	if s.eyes != nil {
+		return s.eyes.Close()
+	}
+	return nil
+}
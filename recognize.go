@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+
+	"gocv.io/x/gocv"
+)
+
+// faceResult is what facebox made of one face in a frame.
+type faceResult struct {
+	Rect           image.Rectangle `json:"rect"`
+	Matched        bool            `json:"matched"`
+	StudentName    string          `json:"studentname,omitempty"`
+	Confidence     float64         `json:"confidence,omitempty"`
+	CounselorName  string          `json:"counselorname,omitempty"`
+	CounselorImage string          `json:"counselorimage,omitempty"`
+	Liveness       *livenessResult `json:"liveness,omitempty"`
+	// Aligned is set when the crop sent to facebox was aligned on the eyes;
+	// otherwise AlignError says why not.
+	Aligned    bool   `json:"aligned"`
+	AlignError string `json:"align_error,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// checkable reports whether the face can be checked in.
+func (res faceResult) checkable() bool {
+	return res.Matched && (res.Liveness == nil || !res.Liveness.Blocked)
+}
+
+// faceRecognizer sends faces to facebox one crop at a time, so each student
+// in a frame is recognized on their own and facebox gets a small image.
+type faceRecognizer struct {
+	cfg recognitionConfig
+	// sem limits the requests in flight to facebox across all cameras
+	sem chan struct{}
+}
+
+func newFaceRecognizer(cfg recognitionConfig) *faceRecognizer {
+	return &faceRecognizer{cfg: cfg, sem: make(chan struct{}, cfg.concurrency())}
+}
+
+// identityCache remembers who a face is, so it needn't be sent to facebox
+// again. The track stage is one.
+type identityCache interface {
+	identity(r image.Rectangle) (faceResult, bool)
+	identify(r image.Rectangle, res faceResult)
+}
+
+// recognize cuts every face out of img and recognizes the crops
+// concurrently, except for faces cache already knows. Results are in the
+// order of faces. cache may be nil.
+func (fr *faceRecognizer) recognize(img gocv.Mat, faces []faceCrop, cache identityCache) []faceResult {
+	results := make([]faceResult, len(faces))
+
+	var wg sync.WaitGroup
+	for i, fc := range faces {
+		results[i].Rect = fc.Rect
+		if cache != nil {
+			if res, ok := cache.identity(fc.Rect); ok {
+				results[i] = res
+				continue
+			}
+		}
+
+		// encode here; Mats aren't safe to share between goroutines
+		crop, aligned, reason := fr.normalizedCrop(img, fc)
+		results[i].Aligned, results[i].AlignError = aligned, reason
+		buf, err := gocv.IMEncode(".jpg", crop)
+		crop.Close()
+		if err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+
+		wg.Add(1)
+		go func(res *faceResult, buf []byte) {
+			defer wg.Done()
+			fr.sem <- struct{}{}
+			defer func() { <-fr.sem }()
+			fr.check(res, buf)
+			if cache != nil {
+				cache.identify(res.Rect, *res)
+			}
+		}(&results[i], buf)
+	}
+	wg.Wait()
+	return results
+}
+
+// check asks facebox who is in the crop.
+func (fr *faceRecognizer) check(res *faceResult, buf []byte) {
+	faces, err := fbox.Check(bytes.NewReader(buf))
+	if err != nil {
+		log.Printf("unable to recognize face: %v", err)
+		res.Error = err.Error()
+		return
+	}
+	if len(faces) == 0 || !faces[0].Matched || faces[0].Name == "" {
+		return
+	}
+
+	log.Printf("this photo is  %v ", faces[0].Name)
+	res.Matched = true
+	res.StudentName = faces[0].Name
+	res.Confidence = faces[0].Confidence
+	res.CounselorName, res.CounselorImage = counselorFor(res.StudentName)
+}
+
+// checkins returns the indexes of the recognized faces to check in under
+// the configured policy, the one to show first.
+func (fr *faceRecognizer) checkins(results []faceResult, bounds image.Rectangle) []int {
+	var matched []int
+	for i, res := range results {
+		if res.checkable() {
+			matched = append(matched, i)
+		}
+	}
+	if len(matched) == 0 {
+		return nil
+	}
+
+	if fr.cfg.policy() == "centred" {
+		center := bounds.Min.Add(bounds.Max).Div(2)
+		sort.SliceStable(matched, func(i, j int) bool {
+			return distance(results[matched[i]].Rect, center) < distance(results[matched[j]].Rect, center)
+		})
+		return matched[:1]
+	}
+
+	sort.SliceStable(matched, func(i, j int) bool {
+		return results[matched[i]].Rect.Dx() > results[matched[j]].Rect.Dx()
+	})
+	if fr.cfg.policy() == "all" {
+		return matched
+	}
+	return matched[:1]
+}
+
+// identities returns the camera's identity cache, or nil if its pipeline
+// doesn't track faces.
+func (c *camera) identities() identityCache {
+	if c.tracker == nil {
+		return nil
+	}
+	return c.tracker
+}
+
+// dropUnsure unmatches res if confirmation is on and facebox was too unsure
+// of it to even ask the student, so it is neither checked in nor confirmed.
+func (c *camera) dropUnsure(res *faceResult) {
+	if res.Matched && c.cfg.Confirm.unsure(res.Confidence) {
+		res.Matched = false
+	}
+}
+
+// checkIn publishes a check-in event for a recognized face and records a
+// clip around it. If the face was recognized with too little confidence it
+// asks the student to confirm who they are instead, and reports false.
+func (c *camera) checkIn(res faceResult, auto bool) bool {
+	if c.cfg.Confirm.needed(res.Confidence) {
+		c.askToConfirm(res, auto)
+		return false
+	}
+	c.publishCheckin(res, auto, false)
+	return true
+}
+
+// publishCheckin raises the "checkin" event for res.
+func (c *camera) publishCheckin(res faceResult, auto, confirmed bool) {
+	checkin := event{ID: newEventID(), Type: "checkin", Camera: c.id}
+	checkin.Data = checkinEvent{Student: res.StudentName, Counselor: res.CounselorName, Rect: res.Rect, Auto: auto, Confirmed: confirmed, Liveness: res.Liveness}
+	events.publish(checkin)
+	if c.clips != nil {
+		c.clips.record(checkin.ID)
+	}
+	c.recordCheckin(res.Rect)
+}
+
+// counselorFor assigns a student to a counselor by the first letter of
+// their name.
+func counselorFor(student string) (name, image string) {
+	if strings.ToLower(string(student[0])) < "k" {
+		return "Wink", "wink.jpg"
+	}
+	return "Lizzie", "lizzie.jpg"
+}
+
+// withMargin grows r by margin times its width on every side.
+func withMargin(r image.Rectangle, margin float64) image.Rectangle {
+	m := int(float64(r.Dx()) * margin)
+	return r.Inset(-m)
+}
+
+// distance is how far the centre of r is from p.
+func distance(r image.Rectangle, p image.Point) float64 {
+	c := r.Min.Add(r.Max).Div(2)
+	return math.Hypot(float64(c.X-p.X), float64(c.Y-p.Y))
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+// snapshotOptions are the query parameters accepted by /snapshot.
+type snapshotOptions struct {
+	format    string // "jpg" or "png"
+	maxWidth  int
+	maxHeight int
+	quality   int // JPEG quality, 0 for the encoder default
+	annotated bool
+}
+
+func parseSnapshotOptions(r *http.Request) (snapshotOptions, error) {
+	q := r.URL.Query()
+	opts := snapshotOptions{format: "jpg"}
+
+	switch f := q.Get("format"); f {
+	case "", "jpg", "jpeg":
+	case "png":
+		opts.format = f
+	default:
+		return opts, fmt.Errorf("unsupported format %q", f)
+	}
+
+	ints := []struct {
+		name     string
+		dst      *int
+		min, max int
+	}{
+		{"max_width", &opts.maxWidth, 1, 10000},
+		{"max_height", &opts.maxHeight, 1, 10000},
+		{"quality", &opts.quality, 1, 100},
+	}
+	for _, p := range ints {
+		v := q.Get(p.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < p.min || n > p.max {
+			return opts, fmt.Errorf("%s must be between %d and %d", p.name, p.min, p.max)
+		}
+		*p.dst = n
+	}
+
+	if a := q.Get("annotated"); a != "" {
+		b, err := strconv.ParseBool(a)
+		if err != nil {
+			return opts, fmt.Errorf("annotated must be true or false")
+		}
+		opts.annotated = b
+	}
+	return opts, nil
+}
+
+// etag identifies one rendering of one frame, so pollers asking for the same
+// size and format get a 304 until the camera produces a new frame.
+func (o snapshotOptions) etag(camera string, seq uint64) string {
+	return fmt.Sprintf(`"%s-%d-%s-%dx%d-q%d-%t"`, camera, seq, o.format, o.maxWidth, o.maxHeight, o.quality, o.annotated)
+}
+
+// etagMatches reports whether an If-None-Match header names etag. The header
+// is a comma-separated list, and since If-None-Match compares weakly a W/
+// prefix on either side is ignored.
+func etagMatches(header, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// snapshot serves the latest frame of a camera as a single still image.
+func snapshot(w http.ResponseWriter, r *http.Request) {
+
+	cam, ok := cameras.lookup(r)
+	if !ok {
+		http.Error(w, "unknown camera", http.StatusNotFound)
+		return
+	}
+
+	opts, err := parseSnapshotOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	output := "raw"
+	if opts.annotated {
+		output = "annotated"
+	}
+	out, ok := cam.outputs[output]
+	if !ok {
+		http.Error(w, "camera has no "+output+" output", http.StatusNotFound)
+		return
+	}
+
+	frame, err := out.frames.Latest(2 * time.Second)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer frame.Close()
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "no-cache")
+	etag := opts.etag(cam.id, frame.Seq)
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	fitWithin(&frame.Mat, opts.maxWidth, opts.maxHeight)
+
+	buf, err := encodeSnapshot(frame.Mat, opts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if opts.format == "png" {
+		w.Header().Set("Content-Type", "image/png")
+	} else {
+		w.Header().Set("Content-Type", "image/jpeg")
+	}
+	http.ServeContent(w, r, "", frame.Time, bytes.NewReader(buf))
+}
+
+// fitWithin shrinks img in place, keeping its aspect ratio, so that it is no
+// larger than maxWidth by maxHeight. Zero means no limit.
+func fitWithin(img *gocv.Mat, maxWidth, maxHeight int) {
+	scale := 1.0
+	if maxWidth > 0 && img.Cols() > maxWidth {
+		scale = float64(maxWidth) / float64(img.Cols())
+	}
+	if maxHeight > 0 && float64(img.Rows())*scale > float64(maxHeight) {
+		scale = float64(maxHeight) / float64(img.Rows())
+	}
+	if scale >= 1 {
+		return
+	}
+
+	size := image.Pt(int(float64(img.Cols())*scale+0.5), int(float64(img.Rows())*scale+0.5))
+	gocv.Resize(*img, img, size, 0, 0, gocv.InterpolationArea)
+}
+
+// encodeSnapshot encodes img as PNG or JPEG. gocv.IMEncode has no quality
+// parameter, so JPEGs with an explicit quality go through image/jpeg.
+func encodeSnapshot(img gocv.Mat, opts snapshotOptions) ([]byte, error) {
+	if opts.format == "png" {
+		return gocv.IMEncode(gocv.PNGFileExt, img)
+	}
+	if opts.quality == 0 {
+		return gocv.IMEncode(gocv.JPEGFileExt, img)
+	}
+
+	goImg, err := img.ToImage()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, goImg, &jpeg.Options{Quality: opts.quality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestETagMatches(t *testing.T) {
+	const etag = `"north-7-jpg-0x0-q0-false"`
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{``, false},
+		{`"north-7-jpg-0x0-q0-false"`, true},
+		{`"north-6-jpg-0x0-q0-false"`, false},
+		// a list, with or without spaces after the commas
+		{`"north-6-jpg-0x0-q0-false", "north-7-jpg-0x0-q0-false"`, true},
+		{`"north-6-jpg-0x0-q0-false","north-7-jpg-0x0-q0-false"`, true},
+		{`"north-5-jpg-0x0-q0-false", "north-6-jpg-0x0-q0-false"`, false},
+		// If-None-Match compares weakly
+		{`W/"north-7-jpg-0x0-q0-false"`, true},
+		{`*`, true},
+	}
+	for _, tt := range tests {
+		if got := etagMatches(tt.header, etag); got != tt.want {
+			t.Errorf("etagMatches(%q, %q) = %t, want %t", tt.header, etag, got, tt.want)
+		}
+	}
+}
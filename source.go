@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+// FrameSource is where the capture goroutine gets its frames from: a webcam,
+// a video file or URL, or a directory of stills. Read returns io.EOF once a
+// non-looping recording has been played to the end.
+type FrameSource interface {
+	Read(img *gocv.Mat) error
+	Close() error
+}
+
+// propertySetter is implemented by sources that accept capture properties,
+// which is every source backed by a gocv.VideoCapture.
+type propertySetter interface {
+	Set(prop gocv.VideoCaptureProperties, value float64)
+}
+
+// errNoFrame is returned when a source is open but did not deliver a frame.
+var errNoFrame = errors.New("source returned no frame")
+
+// openSource opens the frame source described by cfg.
+func openSource(cfg sourceConfig) (FrameSource, error) {
+	switch cfg.Type {
+	case "", "device":
+		vc, _ := gocv.VideoCaptureDevice(cfg.Device)
+		if !vc.IsOpened() {
+			vc.Close()
+			return nil, fmt.Errorf("can't open camera device %d", cfg.Device)
+		}
+		return &captureSource{vc: vc}, nil
+
+	case "file", "url":
+		vc, _ := gocv.VideoCaptureFile(cfg.Path)
+		if !vc.IsOpened() {
+			vc.Close()
+			return nil, fmt.Errorf("can't open video %q", cfg.Path)
+		}
+		src := &captureSource{vc: vc}
+		// recordings play back in real time, live URLs arrive at their own pace
+		if cfg.Type == "file" {
+			fps := cfg.FPS
+			if fps <= 0 {
+				fps = vc.Get(gocv.VideoCaptureFPS)
+			}
+			src.interval = frameInterval(fps)
+			src.loop = cfg.Loop
+			src.seekable = true
+		}
+		return src, nil
+
+	case "dir":
+		return newDirSource(cfg.Path, cfg.FPS, cfg.Loop)
+	}
+
+	return nil, fmt.Errorf("unknown source type %q", cfg.Type)
+}
+
+// frameInterval converts a frame rate to the delay between frames, defaulting
+// to 10 fps when the rate is unknown.
+func frameInterval(fps float64) time.Duration {
+	if fps <= 0 {
+		fps = 10
+	}
+	return time.Duration(float64(time.Second) / fps)
+}
+
+// captureSource reads from a gocv.VideoCapture opened on a device, file or URL.
+type captureSource struct {
+	vc       *gocv.VideoCapture
+	interval time.Duration
+	seekable bool
+	loop     bool
+	last     time.Time
+}
+
+func (s *captureSource) Read(img *gocv.Mat) error {
+	s.pace()
+
+	if ok := s.vc.Read(img); ok && !img.Empty() {
+		return nil
+	}
+	if !s.seekable {
+		return errNoFrame
+	}
+	if !s.loop {
+		return io.EOF
+	}
+
+	// rewind the recording and try once more
+	s.vc.Set(gocv.VideoCapturePosFrames, 0)
+	if ok := s.vc.Read(img); !ok || img.Empty() {
+		return errNoFrame
+	}
+	return nil
+}
+
+// pace sleeps so that recordings are not read faster than their frame rate.
+func (s *captureSource) pace() {
+	if s.interval == 0 {
+		return
+	}
+	if wait := s.interval - time.Since(s.last); wait > 0 {
+		time.Sleep(wait)
+	}
+	s.last = time.Now()
+}
+
+func (s *captureSource) Set(prop gocv.VideoCaptureProperties, value float64) {
+	s.vc.Set(prop, value)
+}
+
+func (s *captureSource) Close() error {
+	return s.vc.Close()
+}
+
+// dirSource replays the JPEGs in a directory, in name order, at a fixed rate.
+type dirSource struct {
+	files    []string
+	next     int
+	loop     bool
+	interval time.Duration
+	last     time.Time
+}
+
+func newDirSource(dir string, fps float64, loop bool) (*dirSource, error) {
+	var files []string
+	for _, pattern := range []string{"*.jpg", "*.jpeg", "*.JPG", "*.JPEG"} {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no jpegs found in %q", dir)
+	}
+	sort.Strings(files)
+
+	return &dirSource{files: files, loop: loop, interval: frameInterval(fps)}, nil
+}
+
+func (s *dirSource) Read(img *gocv.Mat) error {
+	if s.next == len(s.files) {
+		if !s.loop {
+			return io.EOF
+		}
+		s.next = 0
+	}
+
+	if wait := s.interval - time.Since(s.last); wait > 0 {
+		time.Sleep(wait)
+	}
+	s.last = time.Now()
+
+	name := s.files[s.next]
+	s.next++
+
+	still := gocv.IMRead(name, gocv.IMReadColor)
+	defer still.Close()
+	if still.Empty() {
+		return fmt.Errorf("can't read %s", name)
+	}
+	still.CopyTo(*img)
+	return nil
+}
+
+func (s *dirSource) Close() error {
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+
+	"gocv.io/x/gocv"
+)
+
+// The built-in stages. Each is configured by an object in the camera's
+// pipeline config, for example {"type": "enhance", "gamma": 1.5}.
+func init() {
+	RegisterProcessor("enhance", newEnhanceStage)
+	RegisterProcessor("overlay", newOverlayStage)
+	RegisterProcessor("encode", newEncodeStage)
+}
+
+// enhanceStage applies an enhancer to the image. Its settings are those of
+// enhanceConfig.
+type enhanceStage struct {
+	e *enhancer
+}
+
+func newEnhanceStage(cam *camera, output string, params json.RawMessage) (Processor, error) {
+	var cfg enhanceConfig
+	if err := json.Unmarshal(params, &cfg); err != nil {
+		return nil, err
+	}
+	switch cfg.Equalize {
+	case "", "hist", "clahe":
+	default:
+		return nil, fmt.Errorf("unknown equalize %q", cfg.Equalize)
+	}
+	return &enhanceStage{e: newEnhancer(cfg)}, nil
+}
+
+func (s *enhanceStage) Process(ctx *FrameContext) error {
+	s.e.apply(&ctx.Image)
+	return nil
+}
+
+func (s *enhanceStage) Close() error {
+	return s.e.Close()
+}
+
+// overlayStage draws what the pipeline knows about the frame onto the image:
+// the detected faces with their track and student, the guidance prompt, and
+// the camera, capture time and frame number.
+type overlayStage struct{}
+
+func newOverlayStage(cam *camera, output string, params json.RawMessage) (Processor, error) {
+	return &overlayStage{}, nil
+}
+
+func (s *overlayStage) Process(ctx *FrameContext) error {
+	for i, r := range ctx.Faces {
+		gocv.Rectangle(&ctx.Image, r, blue, 2)
+		if i < len(ctx.Tracks) {
+			name := ctx.Tracks[i].ID
+			if ctx.Tracks[i].Student != "" {
+				name = ctx.Tracks[i].Student
+			}
+			gocv.PutText(&ctx.Image, name, image.Pt(r.Min.X, r.Min.Y-6), gocv.FontHersheySimplex, 0.5, blue, 2)
+		}
+	}
+
+	if g := ctx.Guidance; g != nil && g.Message != "" {
+		size := gocv.GetTextSize(g.Message, gocv.FontHersheySimplex, 1.2, 3)
+		at := image.Pt((ctx.Image.Cols()-size.X)/2, ctx.Image.Rows()-30)
+		gocv.PutText(&ctx.Image, g.Message, at, gocv.FontHersheySimplex, 1.2, color.RGBA{0, 0, 0, 0}, 8)
+		gocv.PutText(&ctx.Image, g.Message, at, gocv.FontHersheySimplex, 1.2, color.RGBA{255, 255, 255, 0}, 3)
+	}
+
+	label := fmt.Sprintf("%s %s #%d", ctx.Camera, ctx.Time.Format("2006-01-02 15:04:05.000"), ctx.Seq)
+	gocv.PutText(&ctx.Image, label, image.Pt(10, 25), gocv.FontHersheySimplex, 0.6, color.RGBA{0, 0, 0, 0}, 4)
+	gocv.PutText(&ctx.Image, label, image.Pt(10, 25), gocv.FontHersheySimplex, 0.6, color.RGBA{255, 255, 255, 0}, 1)
+	return nil
+}
+
+func (s *overlayStage) Close() error {
+	return nil
+}
+
+// encodeStage JPEG-encodes the image onto its output's mjpeg stream. It only
+// belongs at the end of an output branch, and skips the work while nobody is
+// watching the stream.
+type encodeStage struct {
+	stream *mjpegStream
+}
+
+func newEncodeStage(cam *camera, output string, params json.RawMessage) (Processor, error) {
+	if output == "" {
+		return nil, errors.New("encode only works in an output branch")
+	}
+	return &encodeStage{stream: cam.outputs[output].stream}, nil
+}
+
+func (s *encodeStage) Process(ctx *FrameContext) error {
+	if s.stream.clients() == 0 {
+		return nil
+	}
+	buf, err := gocv.IMEncode(".jpg", ctx.Image)
+	if err != nil {
+		return fmt.Errorf("unable to encode matrix: %v", err)
+	}
+	s.stream.UpdateJPEG(buf, true, ctx.Time)
+	return nil
+}
+
+func (s *encodeStage) Close() error {
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const boundaryWord = "MJPEGBOUNDARY"
+
+// partHeader is written before every JPEG. X-Timestamp is the capture time in
+// Unix seconds, X-Frame-Seq the stream's own sequence number (gaps mean the
+// client dropped frames) and X-Camera-ID the camera it came from.
+const partHeader = "\r\n" +
+	"--" + boundaryWord + "\r\n" +
+	"Content-Type: image/jpeg\r\n" +
+	"Content-Length: %d\r\n" +
+	"X-Timestamp: %d.%06d\r\n" +
+	"X-Frame-Seq: %d\r\n" +
+	"X-Camera-ID: %s\r\n" +
+	"\r\n"
+
+// placeholderHeader is used for generated frames such as the offline
+// placeholder, which have no capture sequence number.
+const placeholderHeader = "\r\n" +
+	"--" + boundaryWord + "\r\n" +
+	"Content-Type: image/jpeg\r\n" +
+	"Content-Length: %d\r\n" +
+	"X-Timestamp: %d.%06d\r\n" +
+	"X-Camera-ID: %s\r\n" +
+	"\r\n"
+
+// mjpegStream serves one camera's frames as multipart/x-mixed-replace. Unlike
+// hybridgroup/mjpeg it stamps each part with the real capture time, frame
+// sequence number and camera ID, so clients can measure latency and drops.
+type mjpegStream struct {
+	camera string
+
+	lock sync.Mutex
+	m    map[chan []byte]bool
+	seq  uint64
+}
+
+func newMJPEGStream(camera string) *mjpegStream {
+	return &mjpegStream{camera: camera, m: make(map[chan []byte]bool)}
+}
+
+// ServeHTTP streams frames to the client until it disconnects.
+func (s *mjpegStream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Println("Stream:", r.RemoteAddr, "connected to", s.camera)
+	w.Header().Add("Content-Type", "multipart/x-mixed-replace;boundary="+boundaryWord)
+	w.Header().Set("Access-Control-Expose-Headers", "X-Timestamp, X-Frame-Seq, X-Camera-ID")
+
+	c := make(chan []byte)
+	s.lock.Lock()
+	s.m[c] = true
+	s.lock.Unlock()
+
+	var sent int
+	for {
+		b := <-c
+		if _, err := w.Write(b); err != nil {
+			break
+		}
+		sent++
+	}
+
+	s.lock.Lock()
+	delete(s.m, c)
+	s.lock.Unlock()
+	log.Println("Stream:", r.RemoteAddr, "disconnected from", s.camera, "after", sent, "frames")
+}
+
+// clients returns how many clients are watching the stream.
+func (s *mjpegStream) clients() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.m)
+}
+
+// UpdateJPEG pushes a frame to the clients. Clients still busy writing the
+// previous frame skip this one. Captured frames are numbered by the stream
+// rather than by the broker, so frames the pipeline skipped before encoding,
+// such as those held back by the motion gate, don't look like drops; generated
+// frames such as the offline placeholder carry no number.
+func (s *mjpegStream) UpdateJPEG(jpeg []byte, captured bool, at time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var header string
+	if captured {
+		s.seq++
+		header = fmt.Sprintf(partHeader, len(jpeg), at.Unix(), at.Nanosecond()/1000, s.seq, s.camera)
+	} else {
+		header = fmt.Sprintf(placeholderHeader, len(jpeg), at.Unix(), at.Nanosecond()/1000, s.camera)
+	}
+
+	// every frame gets its own buffer since clients write it concurrently
+	frame := make([]byte, len(header)+len(jpeg))
+	copy(frame, header)
+	copy(frame[len(header):], jpeg)
+
+	for c := range s.m {
+		select {
+		case c <- frame:
+		default:
+		}
+	}
+}
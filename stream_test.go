@@ -0,0 +1,31 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamSeq(t *testing.T) {
+	s := newMJPEGStream("north")
+	c := make(chan []byte, 4)
+	s.m[c] = true
+
+	// the stream numbers the frames it is handed, whatever the broker
+	// skipped in between, and leaves the placeholder unnumbered
+	now := time.Now()
+	s.UpdateJPEG([]byte("one"), true, now)
+	s.UpdateJPEG([]byte("offline"), false, now)
+	s.UpdateJPEG([]byte("two"), true, now)
+
+	for _, want := range []string{"X-Frame-Seq: 1\r\n", "", "X-Frame-Seq: 2\r\n"} {
+		part := string(<-c)
+		if want == "" {
+			if strings.Contains(part, "X-Frame-Seq") {
+				t.Errorf("placeholder part has a sequence number:\n%s", part)
+			}
+		} else if !strings.Contains(part, want) {
+			t.Errorf("part doesn't contain %q:\n%s", want, part)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+// cameraState is where the supervisor thinks the camera is.
+type cameraState string
+
+const (
+	stateStarting     cameraState = "starting"
+	stateStreaming    cameraState = "streaming"
+	stateStalled      cameraState = "stalled"
+	stateDisconnected cameraState = "disconnected"
+)
+
+// supervisor owns the frame source. It reopens the source with exponential
+// backoff when reads fail, treats frames that stay identical as a frozen
+// camera, and publishes every good frame to the broker.
+type supervisor struct {
+	cam    cameraConfig
+	cfg    supervisorConfig
+	frames *frameBroker
+
+	lock       sync.Mutex
+	state      cameraState
+	since      time.Time
+	lastErr    string
+	lastErrAt  time.Time
+	lastFrame  time.Time
+	reconnects int
+}
+
+// cameraHealth is the JSON served at /health/camera.
+type cameraHealth struct {
+	Camera      string      `json:"camera"`
+	State       cameraState `json:"state"`
+	Since       time.Time   `json:"since"`
+	LastError   string      `json:"last_error,omitempty"`
+	LastErrorAt *time.Time  `json:"last_error_at,omitempty"`
+	LastFrame   *time.Time  `json:"last_frame,omitempty"`
+	Reconnects  int         `json:"reconnects"`
+	// Tamper is set when tamper detection is on for the camera.
+	Tamper *tamperStatus `json:"tamper,omitempty"`
+	// Privacy is how each output hides faces: "off", "blur" or "pixelate".
+	Privacy map[string]string `json:"privacy,omitempty"`
+}
+
+func newSupervisor(cam cameraConfig, cfg supervisorConfig, frames *frameBroker) *supervisor {
+	return &supervisor{
+		cam:    cam,
+		cfg:    cfg,
+		frames: frames,
+		state:  stateStarting,
+		since:  time.Now(),
+	}
+}
+
+// run opens and reads the source until a non-looping recording ends.
+func (s *supervisor) run() {
+
+	backoff := s.cfg.minBackoff()
+	for {
+		source, err := openSource(s.cam.Source)
+		if err != nil {
+			s.fail(stateDisconnected, err.Error())
+			log.Printf("camera %s: %v, retrying in %v", s.cam.ID, err, backoff)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > s.cfg.maxBackoff() {
+				backoff = s.cfg.maxBackoff()
+			}
+			continue
+		}
+		applyCaptureProperties(s.cam, source)
+
+		finished, live := s.read(source)
+		source.Close()
+		if finished {
+			s.fail(stateDisconnected, "frame source finished")
+			log.Printf("camera %s: frame source finished", s.cam.ID)
+			return
+		}
+
+		s.lock.Lock()
+		s.reconnects++
+		s.lock.Unlock()
+
+		// a camera that opens but never streams backs off like one that
+		// doesn't open at all
+		if live {
+			backoff = s.cfg.minBackoff()
+			continue
+		}
+		log.Printf("camera %s: no live frames, retrying in %v", s.cam.ID, backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > s.cfg.maxBackoff() {
+			backoff = s.cfg.maxBackoff()
+		}
+	}
+}
+
+// read publishes frames until the source fails or freezes. It reports whether
+// the source has ended for good, and whether it was live: whether it
+// delivered a frame that differed from the one before it.
+func (s *supervisor) read(source FrameSource) (finished, live bool) {
+
+	img := gocv.NewMat()
+	defer img.Close()
+	prev := gocv.NewMat()
+	defer prev.Close()
+	diff := gocv.NewMat()
+	defer diff.Close()
+	transform := newFrameTransform(s.cam)
+	defer transform.Close()
+
+	var failingSince, frozenSince time.Time
+	for {
+		err := source.Read(&img)
+		if err == io.EOF {
+			return true, live
+		}
+		if err != nil {
+			if failingSince.IsZero() {
+				failingSince = time.Now()
+			}
+			if time.Since(failingSince) > s.cfg.readTimeout() {
+				s.fail(stateDisconnected, err.Error())
+				log.Printf("camera %s: %v, reopening", s.cam.ID, err)
+				return false, live
+			}
+			// don't spin on a camera that has gone away
+			time.Sleep(50 * time.Millisecond)
+			continue
+		}
+		failingSince = time.Time{}
+
+		if sameFrame(img, prev, &diff) {
+			if frozenSince.IsZero() {
+				frozenSince = time.Now()
+			}
+			if time.Since(frozenSince) > s.cfg.stallAfter() {
+				s.fail(stateStalled, "camera frames frozen")
+				log.Printf("camera %s: frames frozen for %v, reopening", s.cam.ID, s.cfg.stallAfter())
+				return false, live
+			}
+		} else {
+			live = live || !prev.Empty()
+			frozenSince = time.Time{}
+			img.CopyTo(prev)
+		}
+
+		s.frames.publish(transform.apply(img))
+		s.streaming()
+	}
+}
+
+// sameFrame reports whether a and b are pixel-for-pixel identical.
+func sameFrame(a, b gocv.Mat, diff *gocv.Mat) bool {
+	if a.Rows() != b.Rows() || a.Cols() != b.Cols() || a.Type() != b.Type() {
+		return false
+	}
+	gocv.AbsDiff(a, b, diff)
+	sum := diff.Sum()
+	return sum.Val1 == 0 && sum.Val2 == 0 && sum.Val3 == 0 && sum.Val4 == 0
+}
+
+func (s *supervisor) streaming() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.lastFrame = time.Now()
+	if s.state != stateStreaming {
+		s.state = stateStreaming
+		s.since = s.lastFrame
+	}
+}
+
+func (s *supervisor) fail(state cameraState, reason string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.lastErr = reason
+	s.lastErrAt = time.Now()
+	if s.state != state {
+		s.state = state
+		s.since = s.lastErrAt
+	}
+}
+
+// State returns the camera's current state.
+func (s *supervisor) State() cameraState {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.state
+}
+
+// Health returns a snapshot of the camera's state for the health endpoint.
+func (s *supervisor) Health() cameraHealth {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	h := cameraHealth{Camera: s.cam.ID, State: s.state, Since: s.since, LastError: s.lastErr, Reconnects: s.reconnects}
+	if !s.lastErrAt.IsZero() {
+		at := s.lastErrAt
+		h.LastErrorAt = &at
+	}
+	if !s.lastFrame.IsZero() {
+		at := s.lastFrame
+		h.LastFrame = &at
+	}
+	return h
+}
+
+// offlineFrame renders the placeholder streamed while the camera is down.
+func offlineFrame(state cameraState, at time.Time) gocv.Mat {
+	img := gocv.NewMatWithSizeFromScalar(gocv.NewScalar(40, 40, 40, 0), 480, 640, gocv.MatTypeCV8UC3)
+	white := color.RGBA{255, 255, 255, 0}
+	gocv.PutText(&img, "camera offline", image.Pt(150, 220), gocv.FontHersheySimplex, 1.5, white, 3)
+	gocv.PutText(&img, string(state)+" "+at.Format("15:04:05"), image.Pt(150, 280), gocv.FontHersheySimplex, 0.8, white, 2)
+	return img
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+// tamperState is what the tamper detector thinks has happened to the camera.
+type tamperState string
+
+const (
+	tamperLearning  tamperState = "learning"
+	tamperOK        tamperState = "ok"
+	tamperCovered   tamperState = "covered"
+	tamperMoved     tamperState = "moved"
+	tamperDefocused tamperState = "defocused"
+)
+
+// tamperWidth is the width frames are scaled to before they are checked.
+const tamperWidth = 320
+
+// tamperStatus is reported in the camera health and in "tamper" events.
+type tamperStatus struct {
+	State  tamperState `json:"state"`
+	Since  time.Time   `json:"since"`
+	Reason string      `json:"reason,omitempty"`
+}
+
+// tamperBaseline is what the camera normally sees.
+type tamperBaseline struct {
+	keypoints   []gocv.KeyPoint
+	descriptors gocv.Mat
+	sharpness   float64
+}
+
+// tamperDetector compares a camera's frames against a baseline learned when
+// it starts. A near-uniform frame means the lens is covered, ORB keypoints
+// that no longer match or have shifted mean the camera was moved, and a
+// collapse in Laplacian variance means it was knocked out of focus. A state
+// has to persist for a while before it is reported, so a student standing
+// close to the kiosk doesn't raise an alarm.
+type tamperDetector struct {
+	camera string
+	cfg    tamperConfig
+	frames *frameBroker
+
+	orb     gocv.ORB
+	matcher gocv.BFMatcher
+
+	lock      sync.Mutex
+	status    tamperStatus
+	baseline  *tamperBaseline
+	relearn   bool
+	candidate tamperState
+	candSince time.Time
+}
+
+func newTamperDetector(camera string, cfg tamperConfig, frames *frameBroker) *tamperDetector {
+	return &tamperDetector{
+		camera:  camera,
+		cfg:     cfg,
+		frames:  frames,
+		orb:     gocv.NewORB(),
+		matcher: gocv.NewBFMatcherWithParams(gocv.NormHamming, false),
+		status:  tamperStatus{State: tamperLearning, Since: time.Now()},
+	}
+}
+
+// run checks a frame every interval.
+func (t *tamperDetector) run() {
+
+	started := time.Now()
+	for {
+		time.Sleep(t.cfg.interval())
+
+		frame, err := t.frames.Latest(time.Second)
+		if err != nil {
+			continue
+		}
+		gray := toGray(frame.Mat, tamperWidth)
+		frame.Close()
+
+		t.lock.Lock()
+		learn := t.baseline == nil || t.relearn
+		t.lock.Unlock()
+
+		if learn {
+			// let auto exposure settle before learning what normal looks like
+			if time.Since(started) >= t.cfg.learnAfter() {
+				t.learn(gray)
+			}
+		} else {
+			t.check(gray)
+		}
+		gray.Close()
+	}
+}
+
+// rebaseline makes the detector learn a new baseline from the next frame,
+// for example after the camera was moved on purpose.
+func (t *tamperDetector) rebaseline() {
+	t.lock.Lock()
+	t.relearn = true
+	t.lock.Unlock()
+}
+
+func (t *tamperDetector) learn(gray gocv.Mat) {
+	if _, stddev := meanStdDev(gray); stddev < t.cfg.coveredStdDev() {
+		// don't learn a covered lens as normal
+		return
+	}
+
+	mask := gocv.NewMat()
+	defer mask.Close()
+	kp, desc := t.orb.DetectAndCompute(gray, mask)
+
+	b := &tamperBaseline{keypoints: kp, descriptors: desc, sharpness: laplacianVariance(gray)}
+
+	t.lock.Lock()
+	if t.baseline != nil {
+		t.baseline.descriptors.Close()
+	}
+	t.baseline = b
+	t.relearn = false
+	t.candidate = tamperOK
+	t.lock.Unlock()
+
+	log.Printf("tamper %s: learned baseline with %d keypoints, sharpness %.1f", t.camera, len(kp), b.sharpness)
+	t.transition(tamperOK, "")
+}
+
+// check classifies gray and reports a state once it has persisted.
+func (t *tamperDetector) check(gray gocv.Mat) {
+	state, reason := t.classify(gray)
+
+	t.lock.Lock()
+	if state != t.candidate {
+		t.candidate = state
+		t.candSince = time.Now()
+	}
+	persisted := time.Since(t.candSince) >= t.cfg.hold() || state == tamperOK
+	current := t.status.State
+	t.lock.Unlock()
+
+	if persisted && state != current {
+		t.transition(state, reason)
+	}
+}
+
+func (t *tamperDetector) classify(gray gocv.Mat) (tamperState, string) {
+	if _, stddev := meanStdDev(gray); stddev < t.cfg.coveredStdDev() {
+		return tamperCovered, fmt.Sprintf("frame is nearly uniform (stddev %.1f)", stddev)
+	}
+
+	t.lock.Lock()
+	b := t.baseline
+	t.lock.Unlock()
+
+	if sharpness := laplacianVariance(gray); b.sharpness > 0 && sharpness < b.sharpness*t.cfg.defocusRatio() {
+		return tamperDefocused, fmt.Sprintf("sharpness fell from %.1f to %.1f", b.sharpness, sharpness)
+	}
+
+	if moved, reason := t.moved(gray, b); moved {
+		return tamperMoved, reason
+	}
+	return tamperOK, ""
+}
+
+// moved matches gray's ORB features against the baseline. The camera has
+// moved if few features still match, or if the matches agree on a large
+// shift of the whole scene.
+func (t *tamperDetector) moved(gray gocv.Mat, b *tamperBaseline) (bool, string) {
+	if len(b.keypoints) < 10 {
+		// a featureless scene can't tell us anything
+		return false, ""
+	}
+
+	mask := gocv.NewMat()
+	defer mask.Close()
+	kp, desc := t.orb.DetectAndCompute(gray, mask)
+	defer desc.Close()
+	if len(kp) < 2 || desc.Empty() {
+		return true, "no features left in view"
+	}
+
+	var dx, dy []float64
+	for _, m := range t.matcher.KnnMatch(b.descriptors, desc, 2) {
+		// Lowe's ratio test keeps only distinctive matches
+		if len(m) < 2 || m[0].Distance > 0.75*m[1].Distance {
+			continue
+		}
+		from, to := b.keypoints[m[0].QueryIdx], kp[m[0].TrainIdx]
+		dx = append(dx, to.X-from.X)
+		dy = append(dy, to.Y-from.Y)
+	}
+
+	matched := float64(len(dx)) / float64(len(b.keypoints))
+	if matched < t.cfg.minMatchRatio() {
+		return true, fmt.Sprintf("only %.0f%% of baseline features match", matched*100)
+	}
+
+	shift := math.Hypot(median(dx), median(dy))
+	if limit := t.cfg.maxShift() * float64(gray.Cols()); shift > limit {
+		return true, fmt.Sprintf("scene shifted by %.0f%% of the frame width", shift*100/float64(gray.Cols()))
+	}
+	return false, ""
+}
+
+// transition records a new state and raises a "tamper" event for it.
+func (t *tamperDetector) transition(state tamperState, reason string) {
+	t.lock.Lock()
+	previous := t.status.State
+	t.status = tamperStatus{State: state, Since: time.Now(), Reason: reason}
+	status := t.status
+	t.lock.Unlock()
+
+	if previous == state || (previous == tamperLearning && state == tamperOK) {
+		return
+	}
+	log.Printf("tamper %s: %s -> %s %s", t.camera, previous, state, reason)
+
+	e := events.publish(event{Type: "tamper", Camera: t.camera, Data: status})
+	if t.cfg.Webhook != "" {
+		go postWebhook(t.cfg.Webhook, e)
+	}
+}
+
+// Status returns the detector's current state.
+func (t *tamperDetector) Status() tamperStatus {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.status
+}
+
+// median returns the median of v, reordering it.
+func median(v []float64) float64 {
+	if len(v) == 0 {
+		return 0
+	}
+	sort.Float64s(v)
+	return v[len(v)/2]
+}
@@ -0,0 +1,306 @@
+//go:build ignore
+// +build ignore
+
+// makeclips writes the staged fixture clips under testdata/liveness and
+// testdata/gestures. They are built from gocv's sample face so the
+// repository holds no recordings of students; see the READMEs next to the
+// manifests for what each clip stands in for. Run it from the repository
+// root:
+//
+//	go run testdata/makeclips.go
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+const (
+	width  = 320
+	height = 240
+	fps    = 10
+)
+
+// face is the sample photo all clips are made from.
+const face = "vendor/gocv.io/x/gocv/images/face.jpg"
+
+var (
+	background = color.RGBA{110, 110, 110, 255}
+	skin       = color.RGBA{224, 172, 140, 255}
+)
+
+// The hands, outlined with y pointing down, about 80 by 140 pixels before
+// they are scaled.
+var (
+	thumbsUp = []image.Point{{2, 0}, {8, -6}, {16, -8}, {22, -4}, {24, 80}, {44, 84}, {62, 88}, {72, 92}, {76, 108}, {74, 126}, {64, 134}, {10, 134}, {2, 126}, {0, 108}, {2, 84}}
+	oneUp    = []image.Point{{31, -13}, {38, -16}, {45, -13}, {47, 66}, {70, 76}, {74, 96}, {72, 114}, {62, 122}, {12, 122}, {4, 114}, {2, 96}, {6, 76}, {29, 66}}
+	openPalm = []image.Point{{8, 130}, {2, 118}, {-28, 88}, {-36, 78}, {-32, 70}, {-24, 72}, {2, 90}, {4, 56}, {6, 16}, {13, 12}, {20, 16}, {24, 54}, {30, 54}, {32, 6}, {39, 2}, {46, 6}, {48, 54}, {54, 54}, {56, 10}, {63, 6}, {70, 10}, {72, 56}, {78, 56}, {80, 26}, {86, 22}, {92, 26}, {92, 70}, {88, 118}, {80, 130}}
+	fist     = []image.Point{{10, 0}, {56, 0}, {66, 10}, {66, 48}, {56, 58}, {10, 58}, {0, 48}, {0, 10}}
+)
+
+func main() {
+	f, err := os.Open(face)
+	if err != nil {
+		log.Fatal(err)
+	}
+	photo, err := jpeg.Decode(f)
+	f.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// liveness: the photo fills the frame, as a student would at the kiosk
+	full := func(x, y float64) color.RGBA {
+		return sample(photo, x*float64(photo.Bounds().Dx())/width, y*float64(photo.Bounds().Dy())/height)
+	}
+	clip("testdata/liveness/real/staged-talking.avi", 25, func(n int) image.Image {
+		return talking(full, float64(n)/fps)
+	})
+	clip("testdata/liveness/spoof/print-still.avi", 25, func(n int) image.Image {
+		return render(full)
+	})
+	clip("testdata/liveness/spoof/screen-still.avi", 25, func(n int) image.Image {
+		return screen(render(full))
+	})
+
+	// gestures: the head on a plain wall with a hand raised beside it, so
+	// the hand is the only skin the reader can find
+	head := func(x, y float64) color.RGBA {
+		const scale, left, top = 0.45, 20, 40
+		sx, sy := 220+(x-left)/scale, 60+(y-top)/scale
+		if x < left || y < top || sx >= 480 || sy >= 420 {
+			return background
+		}
+		return sample(photo, sx, sy)
+	}
+	gesture := func(file string, hand []image.Point) {
+		clip(file, 15, func(n int) image.Image {
+			img := render(head)
+			if hand != nil && n >= 3 {
+				// a raised hand is never quite still
+				jitter := image.Pt(int(2*math.Sin(float64(n))), int(2*math.Cos(float64(n)*1.3)))
+				fill(img, hand, 1.2, image.Pt(200, 50).Add(jitter), skin)
+			}
+			return img
+		})
+	}
+	gesture("testdata/gestures/confirm/thumbs-up.avi", thumbsUp)
+	gesture("testdata/gestures/confirm/one-finger.avi", oneUp)
+	gesture("testdata/gestures/reject/open-palm.avi", openPalm)
+	gesture("testdata/gestures/none/fist.avi", fist)
+	gesture("testdata/gestures/none/no-hand.avi", nil)
+}
+
+// talking warps the photo the way a face moves: the jaw opens and closes,
+// the head sways a little more at the chin than at the forehead, and the
+// eyes blink once. None of it moves the face as one piece, which is what
+// the liveness check looks for.
+func talking(src func(x, y float64) color.RGBA, t float64) image.Image {
+	jaw := 2.5 * math.Sin(2*math.Pi*t/0.8)
+	sway := 1.5 * math.Sin(2*math.Pi*t/1.5)
+	img := render(func(x, y float64) color.RGBA {
+		dy := jaw * bump(x, y, 177, 180, 40, 30)
+		dx := sway * bump(x, y, 177, 170, 70, 90) * (y - 80) / 120
+		return src(x-dx, y-dy)
+	})
+	if t >= 1.4 && t < 1.6 {
+		lid := src(177, 95)
+		for _, eye := range []image.Point{{155, 122}, {202, 122}} {
+			for y := eye.Y - 6; y <= eye.Y+6; y++ {
+				for x := eye.X - 10; x <= eye.X+10; x++ {
+					if dx, dy := float64(x-eye.X)/10, float64(y-eye.Y)/6; dx*dx+dy*dy <= 1 {
+						img.SetRGBA(x, y, lid)
+					}
+				}
+			}
+		}
+	}
+	return img
+}
+
+// screen darkens every other column of img, like the pixel grid of a phone
+// held up to the camera.
+func screen(img *image.RGBA) image.Image {
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x += 2 {
+			c := img.RGBAAt(x, y)
+			img.SetRGBA(x, y, color.RGBA{uint8(float64(c.R) * 0.75), uint8(float64(c.G) * 0.8), uint8(float64(c.B) * 0.75), 255})
+		}
+	}
+	return img
+}
+
+// bump is 1 at (cx, cy), falling smoothly to 0 rx and ry away from it.
+func bump(x, y, cx, cy, rx, ry float64) float64 {
+	d := math.Hypot((x-cx)/rx, (y-cy)/ry)
+	if d >= 1 {
+		return 0
+	}
+	return 0.5 + 0.5*math.Cos(math.Pi*d)
+}
+
+func render(src func(x, y float64) color.RGBA) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetRGBA(x, y, src(float64(x)+0.5, float64(y)+0.5))
+		}
+	}
+	return img
+}
+
+// sample reads img at (x, y) with bilinear filtering.
+func sample(img image.Image, x, y float64) color.RGBA {
+	b := img.Bounds()
+	x, y = x-0.5, y-0.5
+	x0, y0 := math.Floor(x), math.Floor(y)
+	fx, fy := x-x0, y-y0
+	at := func(x, y int) [3]float64 {
+		if x < b.Min.X {
+			x = b.Min.X
+		} else if x >= b.Max.X {
+			x = b.Max.X - 1
+		}
+		if y < b.Min.Y {
+			y = b.Min.Y
+		} else if y >= b.Max.Y {
+			y = b.Max.Y - 1
+		}
+		r, g, bl, _ := img.At(x, y).RGBA()
+		return [3]float64{float64(r >> 8), float64(g >> 8), float64(bl >> 8)}
+	}
+	a, c := at(int(x0), int(y0)), at(int(x0)+1, int(y0))
+	d, e := at(int(x0), int(y0)+1), at(int(x0)+1, int(y0)+1)
+	var out [3]uint8
+	for i := range out {
+		top := a[i]*(1-fx) + c[i]*fx
+		bottom := d[i]*(1-fx) + e[i]*fx
+		out[i] = uint8(top*(1-fy) + bottom*fy + 0.5)
+	}
+	return color.RGBA{out[0], out[1], out[2], 255}
+}
+
+// fill paints the polygon outline, scaled and moved to at, in c.
+func fill(img *image.RGBA, outline []image.Point, scale float64, at image.Point, c color.RGBA) {
+	pts := make([][2]float64, len(outline))
+	for i, p := range outline {
+		pts[i] = [2]float64{float64(at.X) + float64(p.X)*scale, float64(at.Y) + float64(p.Y)*scale}
+	}
+	for y := 0; y < height; y++ {
+		py := float64(y) + 0.5
+		var xs []float64
+		for i := range pts {
+			a, b := pts[i], pts[(i+1)%len(pts)]
+			if (a[1] <= py) != (b[1] <= py) {
+				xs = append(xs, a[0]+(py-a[1])/(b[1]-a[1])*(b[0]-a[0]))
+			}
+		}
+		for x := 0; x < width; x++ {
+			px, inside := float64(x)+0.5, false
+			for _, cx := range xs {
+				if cx < px {
+					inside = !inside
+				}
+			}
+			if inside {
+				img.SetRGBA(x, y, c)
+			}
+		}
+	}
+}
+
+// clip writes n frames as a Motion JPEG AVI, which OpenCV reads with or
+// without FFmpeg.
+func clip(file string, n int, frame func(n int) image.Image) {
+	var frames [][]byte
+	for i := 0; i < n; i++ {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, frame(i), &jpeg.Options{Quality: 75}); err != nil {
+			log.Fatal(err)
+		}
+		frames = append(frames, buf.Bytes())
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, avi(frames), 0644); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("wrote %s", file)
+}
+
+func avi(frames [][]byte) []byte {
+	largest := 0
+	for _, f := range frames {
+		if len(f) > largest {
+			largest = len(f)
+		}
+	}
+
+	var movi, index bytes.Buffer
+	movi.WriteString("movi")
+	for _, f := range frames {
+		le(&index, []byte("00dc"), uint32(0x10), uint32(movi.Len()), uint32(len(f)))
+		chunk(&movi, "00dc", f)
+	}
+
+	var avih bytes.Buffer
+	le(&avih, uint32(1000000/fps), uint32(largest*fps), uint32(0), uint32(0x10), uint32(len(frames)),
+		uint32(0), uint32(1), uint32(largest), uint32(width), uint32(height), [4]uint32{})
+	var strh bytes.Buffer
+	le(&strh, []byte("vids"), []byte("MJPG"), uint32(0), uint16(0), uint16(0), uint32(0),
+		uint32(1), uint32(fps), uint32(0), uint32(len(frames)), uint32(largest), int32(-1), uint32(0),
+		[4]int16{0, 0, width, height})
+	var strf bytes.Buffer
+	le(&strf, uint32(40), int32(width), int32(height), uint16(1), uint16(24), []byte("MJPG"),
+		uint32(width*height*3), int32(0), int32(0), uint32(0), uint32(0))
+
+	var strl bytes.Buffer
+	strl.WriteString("strl")
+	chunk(&strl, "strh", strh.Bytes())
+	chunk(&strl, "strf", strf.Bytes())
+	var hdrl bytes.Buffer
+	hdrl.WriteString("hdrl")
+	chunk(&hdrl, "avih", avih.Bytes())
+	chunk(&hdrl, "LIST", strl.Bytes())
+
+	var body bytes.Buffer
+	body.WriteString("AVI ")
+	chunk(&body, "LIST", hdrl.Bytes())
+	chunk(&body, "LIST", movi.Bytes())
+	chunk(&body, "idx1", index.Bytes())
+
+	var out bytes.Buffer
+	chunk(&out, "RIFF", body.Bytes())
+	return out.Bytes()
+}
+
+// chunk writes a RIFF chunk, padded to an even length.
+func chunk(w *bytes.Buffer, id string, data []byte) {
+	w.WriteString(id)
+	le(w, uint32(len(data)))
+	w.Write(data)
+	if len(data)%2 == 1 {
+		w.WriteByte(0)
+	}
+}
+
+func le(w *bytes.Buffer, values ...interface{}) {
+	for _, v := range values {
+		if b, ok := v.([]byte); ok {
+			w.Write(b)
+			continue
+		}
+		if err := binary.Write(w, binary.LittleEndian, v); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+func init() {
+	RegisterProcessor("track", newTrackStage)
+}
+
+// trackState is the stage of a track's life reported in "track" events.
+type trackState string
+
+const (
+	trackAppeared   trackState = "appeared"
+	trackIdentified trackState = "identified"
+	trackLost       trackState = "lost"
+)
+
+// trackEvent is the data of a "track" event.
+type trackEvent struct {
+	Track   string          `json:"track"`
+	State   trackState      `json:"state"`
+	Rect    image.Rectangle `json:"rect"`
+	Student string          `json:"student,omitempty"`
+}
+
+// faceTrack is a face's track as later stages and recognition see it.
+type faceTrack struct {
+	ID      string `json:"id"`
+	Student string `json:"student,omitempty"`
+	// Approach is set by the approach stage.
+	Approach approachState `json:"approach,omitempty"`
+}
+
+// objectTracker follows one face between detections. The trackers in
+// OpenCV contrib are objectTrackers; newTracker, which is only available in
+// builds with the contrib tag, makes them.
+type objectTracker interface {
+	Init(img gocv.Mat, r image.Rectangle) bool
+	Update(img gocv.Mat) (image.Rectangle, bool)
+	Close() error
+}
+
+// track is one face followed across frames. Only a detection refreshes
+// lastDetected: a tracker can keep reporting a box long after the face has
+// gone, so a track no detection has matched for LostAfter is lost.
+type track struct {
+	id           string
+	rect         image.Rectangle
+	tracker      objectTracker
+	lastDetected time.Time
+
+	// identity is what recognition made of the face, reused for as long as
+	// the track lives, or until retryUnknown if facebox didn't know it.
+	identity     *faceResult
+	identifiedAt time.Time
+}
+
+// trackStage gives every face a track ID that stays with it across frames.
+// On frames the detect stage ran it matches detections to tracks by
+// overlap; in between, a contrib tracker follows each face. Recognition
+// results are kept on the track, so a student standing at the kiosk is sent
+// to facebox once rather than on every check.
+type trackStage struct {
+	cam *camera
+	cfg trackConfig
+
+	lock   sync.Mutex
+	tracks []*track
+	next   int
+}
+
+func newTrackStage(cam *camera, output string, params json.RawMessage) (Processor, error) {
+	if output != "" {
+		return nil, errors.New("track only works as a shared stage")
+	}
+	var cfg trackConfig
+	if err := json.Unmarshal(params, &cfg); err != nil {
+		return nil, err
+	}
+	tracker, err := newTracker(cfg.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	tracker.Close()
+
+	s := &trackStage{cam: cam, cfg: cfg}
+	cam.tracker = s
+	return s, nil
+}
+
+func (s *trackStage) Process(ctx *FrameContext) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var seen []*track
+	if ctx.Detected {
+		seen = s.match(ctx)
+		s.expire(ctx)
+	} else {
+		seen = s.follow(ctx)
+	}
+
+	ctx.Faces, ctx.Tracks = nil, nil
+	for _, t := range seen {
+		ft := faceTrack{ID: t.id}
+		if t.identity != nil && t.identity.Matched {
+			ft.Student = t.identity.StudentName
+		}
+		ctx.Faces = append(ctx.Faces, t.rect)
+		ctx.Tracks = append(ctx.Tracks, ft)
+	}
+	return nil
+}
+
+// match continues the tracks that overlap a detection best and starts new
+// tracks for the other detections. It returns the tracks of the detections.
+func (s *trackStage) match(ctx *FrameContext) []*track {
+	type pair struct {
+		det, trk int
+		iou      float64
+	}
+	var pairs []pair
+	for i, r := range ctx.Faces {
+		for j, t := range s.tracks {
+			if v := iou(r, t.rect); v >= s.cfg.matchIoU() {
+				pairs = append(pairs, pair{i, j, v})
+			}
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].iou > pairs[j].iou })
+
+	seen := make([]*track, len(ctx.Faces))
+	used := make([]bool, len(s.tracks))
+	for _, p := range pairs {
+		if seen[p.det] != nil || used[p.trk] {
+			continue
+		}
+		used[p.trk] = true
+		seen[p.det] = s.tracks[p.trk]
+	}
+
+	for i, r := range ctx.Faces {
+		t := seen[i]
+		appeared := t == nil
+		if appeared {
+			s.next++
+			t = &track{id: fmt.Sprintf("%s-%d", ctx.Camera, s.next)}
+			s.tracks = append(s.tracks, t)
+			seen[i] = t
+		}
+		t.rect, t.lastDetected = r, ctx.Time
+		s.restart(t, ctx.Image)
+		if appeared {
+			s.emit(ctx, t, trackAppeared)
+		}
+	}
+	return seen
+}
+
+// expire drops the tracks no detection has matched for LostAfter. It only
+// runs on frames the detect stage ran, so a track isn't lost just because
+// detection runs less often than LostAfter.
+func (s *trackStage) expire(ctx *FrameContext) {
+	live := s.tracks[:0]
+	for _, t := range s.tracks {
+		if ctx.Time.Sub(t.lastDetected) < s.cfg.lostAfter() {
+			live = append(live, t)
+			continue
+		}
+		t.tracker.Close()
+		s.emit(ctx, t, trackLost)
+	}
+	s.tracks = live
+}
+
+// restart starts following t afresh from its detected position. OpenCV's
+// trackers can't be initialised twice, so it gets a new one.
+func (s *trackStage) restart(t *track, img gocv.Mat) {
+	if t.tracker != nil {
+		t.tracker.Close()
+	}
+	t.tracker, _ = newTracker(s.cfg.Algorithm)
+	if !t.tracker.Init(img, t.rect) {
+		log.Printf("camera %s: unable to start tracking %s", s.cam.id, t.id)
+	}
+}
+
+// follow moves every track to where its tracker finds the face, returning the
+// tracks that were found. Being followed doesn't keep a track alive; see
+// expire.
+func (s *trackStage) follow(ctx *FrameContext) []*track {
+	bounds := image.Rect(0, 0, ctx.Image.Cols(), ctx.Image.Rows())
+	var seen []*track
+	for _, t := range s.tracks {
+		r, ok := t.tracker.Update(ctx.Image)
+		if r = r.Intersect(bounds); !ok || r.Empty() {
+			continue
+		}
+		t.rect = r
+		seen = append(seen, t)
+	}
+	return seen
+}
+
+func (s *trackStage) emit(ctx *FrameContext, t *track, state trackState) {
+	data := trackEvent{Track: t.id, State: state, Rect: t.rect}
+	if t.identity != nil {
+		data.Student = t.identity.StudentName
+	}
+	ctx.Emit(event{Type: "track", Data: data})
+}
+
+// trackAt returns the live track that best overlaps r. The lock must be held.
+func (s *trackStage) trackAt(r image.Rectangle) *track {
+	var best *track
+	bestIoU := 0.5
+	for _, t := range s.tracks {
+		if v := iou(r, t.rect); v >= bestIoU {
+			best, bestIoU = t, v
+		}
+	}
+	return best
+}
+
+// identity returns the recognition result of the track of the face at r, if
+// it is still good.
+func (s *trackStage) identity(r image.Rectangle) (faceResult, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	t := s.trackAt(r)
+	if t == nil || t.identity == nil {
+		return faceResult{}, false
+	}
+	if !t.identity.Matched && time.Since(t.identifiedAt) >= s.cfg.retryUnknown() {
+		return faceResult{}, false
+	}
+	res := *t.identity
+	res.Rect = r
+	return res, true
+}
+
+// identify attaches a recognition result to the track of the face at r.
+func (s *trackStage) identify(r image.Rectangle, res faceResult) {
+	if res.Error != "" {
+		return
+	}
+
+	s.lock.Lock()
+	t := s.trackAt(r)
+	if t == nil {
+		s.lock.Unlock()
+		return
+	}
+	known := t.identity != nil && t.identity.Matched
+	t.identity, t.identifiedAt = &res, time.Now()
+	data := trackEvent{Track: t.id, State: trackIdentified, Rect: t.rect, Student: res.StudentName}
+	s.lock.Unlock()
+
+	if res.Matched && !known {
+		events.publish(event{Type: "track", Camera: s.cam.id, Data: data})
+	}
+}
+
+func (s *trackStage) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, t := range s.tracks {
+		t.tracker.Close()
+	}
+	s.tracks = nil
+	return nil
+}
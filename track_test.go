@@ -0,0 +1,69 @@
+package main
+
+import (
+	"image"
+	"testing"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+// stuckTracker keeps reporting the same box, as trackers do when they latch
+// onto the background after the face has gone.
+type stuckTracker struct{ r image.Rectangle }
+
+func (t *stuckTracker) Init(img gocv.Mat, r image.Rectangle) bool   { t.r = r; return true }
+func (t *stuckTracker) Update(img gocv.Mat) (image.Rectangle, bool) { return t.r, true }
+func (t *stuckTracker) Close() error                                { return nil }
+
+// TestTrackExpiry checks that a track the tracker still follows is lost once
+// detections stop matching it.
+func TestTrackExpiry(t *testing.T) {
+	events = newEventHub()
+	got := make(chan event, 16)
+	events.m[got] = true
+
+	img := gocv.NewMatWithSize(480, 640, gocv.MatTypeCV8UC3)
+	defer img.Close()
+
+	start := time.Now()
+	r := image.Rect(100, 100, 200, 200)
+	s := &trackStage{
+		cam:    &camera{id: "lobby"},
+		cfg:    trackConfig{LostAfter: 1},
+		tracks: []*track{{id: "lobby-1", rect: r, tracker: &stuckTracker{r}, lastDetected: start}},
+	}
+
+	frames := []struct {
+		after    time.Duration
+		detected bool
+		tracks   int
+	}{
+		// followed between detections
+		{300 * time.Millisecond, false, 1},
+		// unmatched by a detection, but still within lost_after
+		{600 * time.Millisecond, true, 1},
+		// still followed well after the last detection, but not lost
+		// until a detection frame
+		{1200 * time.Millisecond, false, 1},
+		{1500 * time.Millisecond, true, 0},
+	}
+	for _, f := range frames {
+		ctx := &FrameContext{Camera: "lobby", Image: img, Time: start.Add(f.after), Detected: f.detected}
+		if err := s.Process(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if len(s.tracks) != f.tracks {
+			t.Fatalf("after %v: %d tracks, want %d", f.after, len(s.tracks), f.tracks)
+		}
+	}
+
+	select {
+	case e := <-got:
+		if data := e.Data.(trackEvent); data.Track != "lobby-1" || data.State != trackLost {
+			t.Errorf("got %+v, want lobby-1 lost", data)
+		}
+	default:
+		t.Error("no lost event")
+	}
+}
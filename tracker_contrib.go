@@ -0,0 +1,27 @@
+//go:build contrib
+// +build contrib
+
+package main
+
+import (
+	"fmt"
+
+	"gocv.io/x/gocv/contrib"
+)
+
+// trackingBuilt is set when the kiosk is built with OpenCV contrib, which
+// the track stage needs.
+const trackingBuilt = true
+
+// newTracker returns a contrib tracker by name.
+func newTracker(algorithm string) (objectTracker, error) {
+	switch algorithm {
+	case "", "kcf":
+		return contrib.NewTrackerKCF(), nil
+	case "mil":
+		return contrib.NewTrackerMIL(), nil
+	case "medianflow":
+		return contrib.NewTrackerMedianFlow(), nil
+	}
+	return nil, fmt.Errorf("unknown tracker %q", algorithm)
+}
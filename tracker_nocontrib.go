@@ -0,0 +1,16 @@
+//go:build !contrib
+// +build !contrib
+
+package main
+
+import "errors"
+
+// trackingBuilt is set when the kiosk is built with OpenCV contrib, which
+// the track stage needs.
+const trackingBuilt = false
+
+// newTracker fails: the trackers are in OpenCV contrib, which this build
+// doesn't use.
+func newTracker(algorithm string) (objectTracker, error) {
+	return nil, errors.New("tracking needs OpenCV contrib; build the kiosk with -tags contrib")
+}
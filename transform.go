@@ -0,0 +1,153 @@
+package main
+
+import (
+	"image"
+	"log"
+
+	"gocv.io/x/gocv"
+)
+
+// rotation codes understood by gocv.Rotate.
+const (
+	rotate90Clockwise        = 0
+	rotate180                = 1
+	rotate90CounterClockwise = 2
+)
+
+// applyCaptureProperties sets the camera's resolution, frame rate, exposure and
+// focus on sources backed by a gocv.VideoCapture. Cameras ignore properties
+// they don't support, so these are requests rather than guarantees.
+func applyCaptureProperties(cam cameraConfig, source FrameSource) {
+	setter, ok := source.(propertySetter)
+	if !ok {
+		return
+	}
+
+	if cam.Width > 0 && cam.Height > 0 {
+		setter.Set(gocv.VideoCaptureFrameWidth, float64(cam.Width))
+		setter.Set(gocv.VideoCaptureFrameHeight, float64(cam.Height))
+	}
+
+	c := cam.Capture
+	if c.FPS > 0 {
+		setter.Set(gocv.VideoCaptureFPS, c.FPS)
+	}
+	if c.AutoExposure != nil {
+		setter.Set(gocv.VideoCaptureAutoExposure, *c.AutoExposure)
+	}
+	if c.Exposure != nil {
+		setter.Set(gocv.VideoCaptureExposure, *c.Exposure)
+	}
+	if c.AutoFocus != nil {
+		setter.Set(gocv.VideoCaptureAutoFocus, boolProperty(*c.AutoFocus))
+	}
+	if c.Focus != nil {
+		setter.Set(gocv.VideoCaptureFocus, *c.Focus)
+	}
+}
+
+func boolProperty(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// frameTransform is the post-capture stage every frame goes through before it
+// is published: scale to the configured resolution, rotate, mirror, then crop.
+// Because it runs in the capture goroutine, the stream and facebox see the
+// same picture.
+type frameTransform struct {
+	id            string
+	width, height int
+	cfg           transformConfig
+	warned        bool
+
+	scaled, rotated, mirrored, cropped gocv.Mat
+}
+
+func newFrameTransform(cam cameraConfig) *frameTransform {
+	switch cam.Transform.Rotate {
+	case 0, 90, 180, 270:
+	default:
+		log.Printf("camera %s: ignoring rotation of %d degrees, use 0, 90, 180 or 270", cam.ID, cam.Transform.Rotate)
+		cam.Transform.Rotate = 0
+	}
+
+	return &frameTransform{
+		id:       cam.ID,
+		width:    cam.Width,
+		height:   cam.Height,
+		cfg:      cam.Transform,
+		scaled:   gocv.NewMat(),
+		rotated:  gocv.NewMat(),
+		mirrored: gocv.NewMat(),
+		cropped:  gocv.NewMat(),
+	}
+}
+
+// apply returns the transformed frame. The result is either img itself or a
+// Mat owned by the transform that stays valid until the next call.
+func (t *frameTransform) apply(img gocv.Mat) gocv.Mat {
+	if t.width > 0 && t.height > 0 && (img.Cols() != t.width || img.Rows() != t.height) {
+		if !t.warned {
+			log.Printf("camera %s: device delivers %dx%d instead of %dx%d, cropping to the aspect ratio and scaling", t.id, img.Cols(), img.Rows(), t.width, t.height)
+			t.warned = true
+		}
+		region := img.Region(aspectCrop(img.Cols(), img.Rows(), t.width, t.height))
+		gocv.Resize(region, &t.scaled, image.Pt(t.width, t.height), 0, 0, gocv.InterpolationLinear)
+		region.Close()
+		img = t.scaled
+	}
+
+	switch t.cfg.Rotate {
+	case 90:
+		gocv.Rotate(img, &t.rotated, rotate90Clockwise)
+		img = t.rotated
+	case 180:
+		gocv.Rotate(img, &t.rotated, rotate180)
+		img = t.rotated
+	case 270:
+		gocv.Rotate(img, &t.rotated, rotate90CounterClockwise)
+		img = t.rotated
+	}
+
+	if t.cfg.Mirror {
+		gocv.Flip(img, &t.mirrored, 1)
+		img = t.mirrored
+	}
+
+	if t.cfg.Crop != nil {
+		roi := t.cfg.Crop.rect().Intersect(image.Rect(0, 0, img.Cols(), img.Rows()))
+		if !roi.Empty() {
+			region := img.Region(roi)
+			region.CopyTo(t.cropped)
+			region.Close()
+			img = t.cropped
+		}
+	}
+
+	return img
+}
+
+// aspectCrop returns the largest centred rectangle of a cols×rows frame with
+// the aspect ratio of width×height, so scaling it to width×height doesn't
+// stretch faces when the device ignored the requested resolution.
+func aspectCrop(cols, rows, width, height int) image.Rectangle {
+	w, h := cols, rows
+	if cols*height > rows*width {
+		w = rows * width / height
+	} else {
+		h = cols * height / width
+	}
+	x, y := (cols-w)/2, (rows-h)/2
+	return image.Rect(x, y, x+w, y+h)
+}
+
+// Close releases the transform's buffers.
+func (t *frameTransform) Close() error {
+	t.scaled.Close()
+	t.rotated.Close()
+	t.mirrored.Close()
+	return t.cropped.Close()
+}
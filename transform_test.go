@@ -0,0 +1,27 @@
+package main
+
+import (
+	"image"
+	"testing"
+)
+
+func TestAspectCrop(t *testing.T) {
+	tests := []struct {
+		cols, rows, width, height int
+		want                      image.Rectangle
+	}{
+		// same aspect ratio, only scaled
+		{640, 480, 1280, 960, image.Rect(0, 0, 640, 480)},
+		// 4:3 device asked for 16:9: top and bottom are cut
+		{640, 480, 1280, 720, image.Rect(0, 60, 640, 420)},
+		// 16:9 device asked for 4:3: the sides are cut
+		{1280, 720, 640, 480, image.Rect(160, 0, 1120, 720)},
+		{1280, 720, 720, 720, image.Rect(280, 0, 1000, 720)},
+	}
+	for _, tt := range tests {
+		got := aspectCrop(tt.cols, tt.rows, tt.width, tt.height)
+		if got != tt.want {
+			t.Errorf("aspectCrop(%d, %d, %d, %d) = %v, want %v", tt.cols, tt.rows, tt.width, tt.height, got, tt.want)
+		}
+	}
+}